@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import "errors"
+
+// freeDisk is not supported on this platform.
+func freeDisk(_ string) (uint64, error) {
+	return 0, errors.New("free disk is not supported on this platform")
+}
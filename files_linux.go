@@ -0,0 +1,11 @@
+//go:build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// setMaxFiles sets the limit of open file descriptors of the process.
+func setMaxFiles(pid, n int) error {
+	lim := unix.Rlimit{Cur: uint64(n), Max: uint64(n)} // #nosec G115
+	return unix.Prlimit(pid, unix.RLIMIT_NOFILE, &lim, nil)
+}
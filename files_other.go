@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// setMaxFiles is not supported on this platform.
+func setMaxFiles(_, _ int) error {
+	return errors.New("file limit is not supported on this platform")
+}
@@ -1,87 +1,1759 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"cmp"
+	"compress/gzip"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net/netip"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode/utf8"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+	"github.com/goccy/go-yaml/parser"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/log"
 	"github.com/gofiber/fiber/v2/middleware/compress"
+	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/healthcheck"
 	"github.com/gofiber/fiber/v2/middleware/helmet"
+	"github.com/gofiber/fiber/v2/middleware/keyauth"
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/fiber/v2/middleware/recover"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"github.com/vmihailenco/msgpack/v5"
 )
 
+// JSON Schema of the request body.
+//
+//go:embed request.schema.json
+var requestSchema []byte
+
+// OpenAPI document without the request schema.
+//
+//go:embed openapi.json
+var openAPIBase []byte
+
 // Request body.
 type Request struct {
-	Options map[string]any `json:"options" validate:"required"`
-	Formula string         `json:"formula" validate:"required"`
-	Timeout int            `json:"timeout" validate:"required,min=1,max=10"`
-	Trace   bool           `json:"trace"`
+	Options          map[string]any `json:"options" validate:"required"`
+	Formula          string         `json:"formula" validate:"required"`
+	Timeout          int            `json:"timeout" validate:"required_without=TimeoutMs,omitempty,min=1,max=10"`
+	TimeoutMs        int            `json:"timeout_ms" validate:"omitempty,min=1,max=10000"`
+	Trace            bool           `json:"trace"`
+	IncludeRawResult bool           `json:"include_raw_result"`
+	Render           string         `json:"render" validate:"omitempty,oneof=pdf"`
+	Dedupe           bool           `json:"dedupe"`
+	Encoding         string         `json:"encoding" validate:"omitempty,oneof=gzip+base64"`
+	OutputFormats    []string       `json:"output_formats" validate:"unique"`
+	AutoDetect       bool           `json:"auto_detect"`
+	Verify           bool           `json:"verify"`
+	Derivation       string         `json:"derivation"`
+}
+
+// exclusiveFields are groups of request fields of which at most one may be set.
+var exclusiveFields = [][]string{
+	{"timeout", "timeout_ms"},
+}
+
+// togetherFields are groups of request fields of which all or none must be set.
+var togetherFields = [][]string{
+	{"verify", "derivation"},
+}
+
+// checkFields enforces exclusiveFields and togetherFields on set request fields.
+func checkFields(req *Request) error {
+	// collect set fields by JSON name
+	set := make(map[string]bool)
+	v := reflect.ValueOf(*req)
+	for i := range v.NumField() {
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		set[name] = !v.Field(i).IsZero()
+	}
+	for _, group := range exclusiveFields {
+		var found []string
+		for _, name := range group {
+			if set[name] {
+				found = append(found, name)
+			}
+		}
+		if len(found) > 1 {
+			return fmt.Errorf("fields are mutually exclusive: %s", strings.Join(found, ", "))
+		}
+	}
+	for _, group := range togetherFields {
+		var missing []string
+		for _, name := range group {
+			if !set[name] {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 && len(missing) < len(group) {
+			return fmt.Errorf("fields are required together: %s; missing: %s", strings.Join(group, ", "), strings.Join(missing, ", "))
+		}
+	}
+	return nil
 }
 
 // Response body.
 type Response struct {
-	Files  map[string]map[string]string `json:"files"`
-	Result map[string]any               `json:"result"`
+	Files    map[string]map[string]string `json:"files"`
+	Result   map[string]any               `json:"result"`
+	Warnings []string                     `json:"warnings"`
+	Blobs    map[string]string            `json:"blobs,omitempty"`
+	Timings  map[string]float64           `json:"timings,omitempty"`
+	Summary  string                       `json:"summary,omitempty"`
+}
+
+// Prover is a prover binary verified at startup.
+type Prover struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+}
+
+// maxOutputDepth is the max depth of nested output directories.
+const maxOutputDepth = 4
+
+// maxLoggedOutput is the max bytes of prover output written to logs.
+const maxLoggedOutput = 4096
+
+// placeholderRegexp matches placeholders in prover arguments.
+var placeholderRegexp = regexp.MustCompile(`\{[^{}]*\}`)
+
+// cleanupWindow is the period in which cleanup failures count for readiness.
+const cleanupWindow = 10 * time.Minute
+
+// sweepInterval is the interval of sweeping retained temp directories.
+const sweepInterval = 10 * time.Minute
+
+// outputPollInterval is the interval of checking the size of files written by the prover.
+const outputPollInterval = 100 * time.Millisecond
+
+// maxDecodedFormula is the maximum size of a decompressed formula in bytes.
+const maxDecodedFormula = 1 << 20
+
+// shutdownGrace is the time to wait for background work on shutdown, after requests finished.
+const shutdownGrace = 5 * time.Second
+
+// Custom response headers.
+const (
+	headerOutcome      = "X-Prover-Outcome"
+	headerCapabilities = "X-Prover-Capabilities"
+	headerSignature    = "X-Signature"
+)
+
+// exposedHeaders are response headers readable by cross-origin clients.
+var exposedHeaders = []string{headerOutcome, headerCapabilities, headerSignature, fiber.HeaderXRequestID, fiber.HeaderRetryAfter}
+
+// mimeMsgpack is the MIME type of MessagePack.
+const mimeMsgpack = "application/msgpack"
+
+// unsafeNameRegexp matches characters not allowed in temp directory names.
+var unsafeNameRegexp = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// maxRequestIDName is the maximum length of a request ID in temp directory names.
+const maxRequestIDName = 64
+
+// spacesRegexp matches runs of spaces and tabs.
+var spacesRegexp = regexp.MustCompile(`[ \t]+`)
+
+// versionTimeout is the timeout of probing prover versions at startup.
+const versionTimeout = 5 * time.Second
+
+// warmFormula is a trivial formula proved to warm up provers.
+const warmFormula = "P → P"
+
+// warmTimeout is the timeout of a warm-up proof, the max prover timeout.
+const warmTimeout = 10 * time.Second
+
+// maxResultDepth is the max nesting depth of result.yaml, checked before parsing,
+// since the YAML parser takes time and memory superlinear in depth.
+const maxResultDepth = 64
+
+// retryAfter is the base delay in seconds suggested to clients on 429/503.
+const retryAfter = 2
+
+// retryMultiplier and retryMaxDelay shape the exponential backoff suggested for
+// repeated retries, with the max delay in seconds.
+const (
+	retryMultiplier = 2
+	retryMaxDelay   = 60
+)
+
+// Config holds settings loaded from environment variables.
+type Config struct {
+	ProverNice              int                       `json:"prover_nice"`
+	RequestTimeout          time.Duration             `json:"request_timeout"`
+	CompressLevel           int                       `json:"compress_level"`
+	CompressMin             int                       `json:"compress_min_size"`
+	ProverEnv               []string                  `json:"prover_env"`
+	PDFRenderer             string                    `json:"pdf_renderer"`
+	Provers                 []string                  `json:"provers"`
+	AdminToken              string                    `json:"admin_token"`
+	ResultMaxSize           int                       `json:"result_max_size"`
+	TrustedProxies          []string                  `json:"trusted_proxies"`
+	ProxyHeader             string                    `json:"proxy_header"`
+	StreamLogs              bool                      `json:"stream_prover_logs"`
+	TraceFallback           bool                      `json:"trace_fallback"`
+	MaxResponseSize         int                       `json:"max_response_size"`
+	ProverArgs              []string                  `json:"prover_args"`
+	CleanupFailureThreshold int                       `json:"cleanup_failure_threshold"`
+	RetainOnError           bool                      `json:"retain_on_error"`
+	RetainTTL               time.Duration             `json:"retain_ttl"`
+	Preprocess              []string                  `json:"preprocess"`
+	SigningKey              string                    `json:"signing_key"`
+	FileTransforms          map[string]string         `json:"file_transforms"`
+	IncludeCommand          bool                      `json:"include_command"`
+	StrictJSON              bool                      `json:"strict_json"`
+	MaxStdoutLines          int                       `json:"max_stdout_lines"`
+	StdoutLimitCancel       bool                      `json:"max_stdout_lines_cancel"`
+	IncludeRunID            bool                      `json:"include_run_id"`
+	IncludeUsage            bool                      `json:"include_usage"`
+	MaxOutputBytes          int                       `json:"max_output_bytes"`
+	OutputFormats           map[string]string         `json:"output_formats"`
+	ProverMaxFiles          int                       `json:"prover_max_files"`
+	ExplanationTemplate     string                    `json:"explanation_template"`
+	UnprovableResults       []string                  `json:"unprovable_results"`
+	MaxOptionsDepth         int                       `json:"max_options_depth"`
+	RecentRuns              int                       `json:"recent_runs"`
+	ProverDefaultOptions    map[string]map[string]any `json:"prover_default_options"`
+	ProverRules             []ProverRule              `json:"prover_rules"`
+	IncludeSummary          bool                      `json:"include_summary"`
+	ResultKeys              []string                  `json:"result_keys"`
+	ResultKeyPolicy         string                    `json:"result_key_policy"`
+	CORSOrigins             string                    `json:"cors_origins"`
+	ExplanationTemplates    map[string]string         `json:"explanation_templates"`
+	ExplanationLanguage     string                    `json:"explanation_language"`
+	VerifyArgs              []string                  `json:"verify_args"`
+	MaxComplexity           int                       `json:"max_complexity"`
+	ComplexityTokens        []string                  `json:"complexity_tokens"`
+
+	// parsed TrustedProxies
+	trustedPrefixes []netip.Prefix
+}
+
+// ProverRule selects a prover for formulas matching a pattern.
+type ProverRule struct {
+	Pattern string `json:"pattern"`
+	Prover  string `json:"prover"`
+	regexp  *regexp.Regexp
+}
+
+// Server holds the config and shared state of handlers.
+type Server struct {
+	config  Config
+	schema  *jsonschema.Schema
+	provers map[string]Prover
+	openAPI []byte
+	// version of the OpenAPI document, advertised as API version
+	apiVersion string
+
+	// explanation templates of results by language, and languages offered
+	// for Accept-Language with the default first
+	explanations map[string]*template.Template
+	languages    []string
+
+	// output of access logs
+	accessLog io.Writer
+	// removes temp directories of requests in the background
+	removeAll func(path string) error
+
+	// background goroutines, waited for on shutdown; later work runs synchronously
+	bgMu      sync.Mutex
+	bgStopped bool
+	bg        sync.WaitGroup
+
+	// set after provers are warmed up; traffic is refused until then
+	ready atomic.Bool
+	// set on shutdown; new requests are refused while in-flight ones finish
+	draining atomic.Bool
+
+	// temp directories of running requests, never swept
+	active sync.Map
+
+	// cleanup failures for readiness
+	cleanupMu       sync.Mutex
+	cleanupTotal    int
+	cleanupFailures []time.Time
+
+	// recent prover runs for post-mortem, oldest first
+	runsMu sync.Mutex
+	runs   []runRecord
+}
+
+// runRecord is a prover run kept for the admin API.
+type runRecord struct {
+	Time        time.Time `json:"time"`
+	Prover      string    `json:"prover"`
+	ExitCode    int       `json:"exit_code"`
+	Timeout     bool      `json:"timeout"`
+	DurationMs  int64     `json:"duration_ms"`
+	FormulaHash string    `json:"formula_hash"`
+	Output      string    `json:"output"`
+}
+
+// preprocess applies the named transform to the formula.
+// It returns false if the transform is unknown.
+func preprocess(name, formula string) (string, bool) {
+	switch name {
+	case "trim":
+		return strings.TrimSpace(formula), true
+	case "normalize_newlines":
+		return strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(formula), true
+	case "collapse_spaces":
+		return spacesRegexp.ReplaceAllString(formula, " "), true
+	default:
+		return formula, false
+	}
+}
+
+// errUnknownTransform is returned for unknown file transforms.
+var errUnknownTransform = errors.New("unknown transform")
+
+// transformFile applies the named transform to an output file.
+func transformFile(name, content string) (string, error) {
+	switch name {
+	case "json_pretty":
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, []byte(content), "", "  "); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	case "json_compact":
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, []byte(content)); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	case "trim":
+		return strings.TrimSpace(content), nil
+	default:
+		return "", errUnknownTransform
+	}
+}
+
+// lineLogger is a writer logging each line of prover output.
+type lineLogger struct {
+	buf []byte
+}
+
+// Write logs complete lines and keeps the rest for the next write.
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+	for {
+		line, rest, ok := bytes.Cut(l.buf, []byte("\n"))
+		if !ok {
+			break
+		}
+		slog.Info("Prover output", "line", string(line))
+		l.buf = rest
+	}
+	return len(p), nil
+}
+
+// Flush logs the last line without newline.
+func (l *lineLogger) Flush() {
+	if len(l.buf) > 0 {
+		slog.Info("Prover output", "line", string(l.buf))
+		l.buf = nil
+	}
+}
+
+// lineLimiter passes output up to max lines and drops the rest with a notice.
+type lineLimiter struct {
+	w         io.Writer
+	max       int
+	lines     int
+	truncated bool
+	onLimit   func()
+}
+
+// Write passes complete lines until the limit is reached.
+func (l *lineLimiter) Write(p []byte) (int, error) {
+	if l.truncated {
+		return len(p), nil
+	}
+	for i, b := range p {
+		if b != '\n' {
+			continue
+		}
+		l.lines++
+		if l.lines < l.max {
+			continue
+		}
+		// cut after the last allowed line
+		l.truncated = true
+		if _, err := l.w.Write(p[:i+1]); err != nil {
+			return 0, err
+		}
+		if _, err := fmt.Fprintf(l.w, "[output truncated after %d lines]\n", l.max); err != nil {
+			return 0, err
+		}
+		if l.onLimit != nil {
+			l.onLimit()
+		}
+		return len(p), nil
+	}
+	return l.w.Write(p)
+}
+
+// byteLimiter passes output up to max bytes and stops the prover when exceeded.
+type byteLimiter struct {
+	w        io.Writer
+	max      int
+	written  int
+	exceeded bool
+	onLimit  func()
+}
+
+// Write passes output until the budget is spent.
+func (l *byteLimiter) Write(p []byte) (int, error) {
+	if l.exceeded {
+		return len(p), nil
+	}
+	if l.written+len(p) <= l.max {
+		l.written += len(p)
+		return l.w.Write(p)
+	}
+	l.exceeded = true
+	if _, err := l.w.Write(p[:l.max-l.written]); err != nil {
+		return 0, err
+	}
+	l.written = l.max
+	l.onLimit()
+	return len(p), nil
+}
+
+// loadConfig reads the config from environment variables.
+func loadConfig() (Config, error) {
+	cfg := Config{}
+	var err error
+
+	// nice value of prover processes
+	if cfg.ProverNice, err = envInt("PROVER_NICE", 0); err != nil {
+		return cfg, err
+	}
+
+	// max total request duration in seconds
+	requestTimeout, err := envInt("REQUEST_TIMEOUT", 15)
+	if err != nil {
+		return cfg, err
+	}
+	// must be longer than the max prover timeout (10s)
+	if requestTimeout <= 10 {
+		return cfg, errors.New("REQUEST_TIMEOUT must be greater than 10")
+	}
+	cfg.RequestTimeout = time.Duration(requestTimeout) * time.Second
+
+	// compression level: -1 (disabled), 0 (default), 1 (best speed), 2 (best compression)
+	if cfg.CompressLevel, err = envInt("COMPRESS_LEVEL", int(compress.LevelDefault)); err != nil {
+		return cfg, err
+	}
+	if cfg.CompressLevel < int(compress.LevelDisabled) || cfg.CompressLevel > int(compress.LevelBestCompression) {
+		return cfg, errors.New("COMPRESS_LEVEL must be between -1 and 2")
+	}
+
+	// min response size in bytes to compress
+	if cfg.CompressMin, err = envInt("COMPRESS_MIN_SIZE", 0); err != nil {
+		return cfg, err
+	}
+
+	// names of environment variables passed to the prover
+	cfg.ProverEnv = envList("PROVER_ENV")
+
+	// LaTeX command to render PDF, such as pdflatex; disabled if empty
+	cfg.PDFRenderer = os.Getenv("PDF_RENDERER")
+
+	// names of prover binaries in bin directory
+	if cfg.Provers = envList("PROVERS"); cfg.Provers == nil {
+		cfg.Provers = []string{"prover", "prover-trace"}
+	}
+
+	// bearer token of admin API; disabled if empty
+	cfg.AdminToken = os.Getenv("ADMIN_TOKEN")
+
+	// max size of result.yaml in bytes
+	if cfg.ResultMaxSize, err = envInt("RESULT_MAX_SIZE", 256<<10); err != nil {
+		return cfg, err
+	}
+
+	// IPs or CIDRs of proxies allowed to set the client IP header
+	cfg.TrustedProxies = envList("TRUSTED_PROXIES")
+	for _, proxy := range cfg.TrustedProxies {
+		prefix, err := netip.ParsePrefix(proxy)
+		if addr, addrErr := netip.ParseAddr(proxy); addrErr == nil {
+			prefix, err = addr.Prefix(addr.BitLen())
+		}
+		if err != nil {
+			return cfg, fmt.Errorf("invalid TRUSTED_PROXIES: %s", proxy)
+		}
+		cfg.trustedPrefixes = append(cfg.trustedPrefixes, prefix)
+	}
+	if cfg.ProxyHeader = os.Getenv("PROXY_HEADER"); cfg.ProxyHeader == "" {
+		cfg.ProxyHeader = fiber.HeaderXForwardedFor
+	}
+
+	// log prover output line by line in real time
+	cfg.StreamLogs = os.Getenv("STREAM_PROVER_LOGS") == "true"
+
+	// retry with non-trace prover if trace prover fails
+	cfg.TraceFallback = os.Getenv("TRACE_FALLBACK") == "true"
+
+	// max lines of captured prover output; unlimited if 0
+	if cfg.MaxStdoutLines, err = envInt("MAX_STDOUT_LINES", 0); err != nil {
+		return cfg, err
+	}
+	cfg.StdoutLimitCancel = os.Getenv("MAX_STDOUT_LINES_CANCEL") == "true"
+
+	// max bytes of prover output before it is stopped; unlimited if 0
+	if cfg.MaxOutputBytes, err = envInt("MAX_OUTPUT_BYTES", 0); err != nil {
+		return cfg, err
+	}
+
+	// max open files of prover; unlimited if 0
+	if cfg.ProverMaxFiles, err = envInt("PROVER_MAX_FILES", 0); err != nil {
+		return cfg, err
+	}
+
+	// max nesting depth of options; unlimited if 0
+	if cfg.MaxOptionsDepth, err = envInt("MAX_OPTIONS_DEPTH", 32); err != nil {
+		return cfg, err
+	}
+
+	// number of recent prover runs kept for the admin API; disabled if 0
+	if cfg.RecentRuns, err = envInt("RECENT_RUNS", 0); err != nil {
+		return cfg, err
+	}
+
+	// max count of complexity tokens in formula; disabled if 0
+	if cfg.MaxComplexity, err = envInt("MAX_COMPLEXITY", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.ComplexityTokens = envList("COMPLEXITY_TOKENS"); cfg.ComplexityTokens == nil {
+		cfg.ComplexityTokens = []string{"¬", "∧", "∨", "→", "↔", "∀", "∃"}
+	}
+
+	// max total bytes of files in response; unlimited if 0
+	if cfg.MaxResponseSize, err = envInt("MAX_RESPONSE_SIZE", 0); err != nil {
+		return cfg, err
+	}
+
+	// recent cleanup failures to report not ready; disabled if 0
+	if cfg.CleanupFailureThreshold, err = envInt("CLEANUP_FAILURE_THRESHOLD", 5); err != nil {
+		return cfg, err
+	}
+	if cfg.CleanupFailureThreshold < 0 {
+		return cfg, errors.New("CLEANUP_FAILURE_THRESHOLD must not be negative")
+	}
+
+	// keep temp directories of failed runs for debugging
+	cfg.RetainOnError = os.Getenv("RETAIN_ON_ERROR") == "true"
+
+	// age in seconds after which temp directories are swept
+	retainTTL, err := envInt("RETAIN_TTL", 86400)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.RetainTTL = time.Duration(retainTTL) * time.Second
+
+	// ordered names of formula transforms
+	cfg.Preprocess = envList("PREPROCESS")
+	for _, name := range cfg.Preprocess {
+		if _, ok := preprocess(name, ""); !ok {
+			return cfg, fmt.Errorf("unknown transform in PREPROCESS: %s", name)
+		}
+	}
+
+	// HMAC key to sign responses; disabled if empty
+	cfg.SigningKey = os.Getenv("RESPONSE_SIGNING_KEY")
+
+	// transforms of output files by extension, such as json=json_pretty
+	for pair := range strings.SplitSeq(os.Getenv("FILE_TRANSFORMS"), ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		ext, name, ok := strings.Cut(pair, "=")
+		if !ok {
+			return cfg, fmt.Errorf("invalid FILE_TRANSFORMS: %s", pair)
+		}
+		if _, err := transformFile(name, ""); errors.Is(err, errUnknownTransform) {
+			return cfg, fmt.Errorf("unknown transform in FILE_TRANSFORMS: %s", name)
+		}
+		if cfg.FileTransforms == nil {
+			cfg.FileTransforms = make(map[string]string)
+		}
+		cfg.FileTransforms[ext] = name
+	}
+
+	// prover flags of output formats, such as svg=--svg
+	for pair := range strings.SplitSeq(os.Getenv("OUTPUT_FORMATS"), ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		format, flag, ok := strings.Cut(pair, "=")
+		if !ok {
+			return cfg, fmt.Errorf("invalid OUTPUT_FORMATS: %s", pair)
+		}
+		if cfg.OutputFormats == nil {
+			cfg.OutputFormats = make(map[string]string)
+		}
+		cfg.OutputFormats[format] = flag
+	}
+
+	// return sanitized prover command in results
+	cfg.IncludeCommand = os.Getenv("INCLUDE_COMMAND") == "true"
+
+	// reject duplicate and unknown keys in JSON bodies
+	cfg.StrictJSON = os.Getenv("STRICT_JSON") == "true"
+
+	// return temp directory name in results for correlation
+	cfg.IncludeRunID = os.Getenv("INCLUDE_RUN_ID") == "true"
+
+	// return resource usage of prover in results
+	cfg.IncludeUsage = os.Getenv("INCLUDE_USAGE") == "true"
+
+	// template of explanation over result fields, such as {{.result}}
+	cfg.ExplanationTemplate = os.Getenv("EXPLANATION_TEMPLATE")
+	// localized explanation templates as JSON object by language, such as {"de": "..."}
+	if v := os.Getenv("EXPLANATION_TEMPLATES"); v != "" {
+		if err := json.Unmarshal([]byte(v), &cfg.ExplanationTemplates); err != nil {
+			return cfg, fmt.Errorf("invalid EXPLANATION_TEMPLATES: %w", err)
+		}
+	}
+	// language of the default explanation template
+	cfg.ExplanationLanguage = cmp.Or(os.Getenv("EXPLANATION_LANGUAGE"), "en")
+
+	// values of result field answered with 422 if client prefers outcome status
+	cfg.UnprovableResults = envList("UNPROVABLE_RESULTS")
+
+	// default options by prover name as JSON object, merged under request options
+	if v := os.Getenv("PROVER_DEFAULT_OPTIONS"); v != "" {
+		if err := json.Unmarshal([]byte(v), &cfg.ProverDefaultOptions); err != nil {
+			return cfg, fmt.Errorf("invalid PROVER_DEFAULT_OPTIONS: %w", err)
+		}
+	}
+
+	// rules to detect prover from formula as JSON array, first match wins
+	if v := os.Getenv("PROVER_RULES"); v != "" {
+		if err := json.Unmarshal([]byte(v), &cfg.ProverRules); err != nil {
+			return cfg, fmt.Errorf("invalid PROVER_RULES: %w", err)
+		}
+	}
+	for i, rule := range cfg.ProverRules {
+		if !slices.Contains(cfg.Provers, rule.Prover) {
+			return cfg, fmt.Errorf("unknown prover in PROVER_RULES: %s", rule.Prover)
+		}
+		if cfg.ProverRules[i].regexp, err = regexp.Compile(rule.Pattern); err != nil {
+			return cfg, fmt.Errorf("invalid pattern in PROVER_RULES: %w", err)
+		}
+	}
+
+	// return one-line summary of results for logging integrations
+	cfg.IncludeSummary = os.Getenv("INCLUDE_SUMMARY") == "true"
+
+	// known keys of result.yaml and policy for unknown ones
+	cfg.ResultKeys = envList("RESULT_KEYS")
+	cfg.ResultKeyPolicy = cmp.Or(os.Getenv("RESULT_KEY_POLICY"), "passthrough")
+	if cfg.ResultKeyPolicy != "passthrough" && cfg.ResultKeyPolicy != "strict" {
+		return cfg, fmt.Errorf("invalid RESULT_KEY_POLICY: %s", cfg.ResultKeyPolicy)
+	}
+	if cfg.ResultKeyPolicy == "strict" && cfg.ResultKeys == nil {
+		return cfg, errors.New("RESULT_KEY_POLICY=strict requires RESULT_KEYS")
+	}
+
+	// comma-separated origins allowed by CORS; disabled if empty
+	cfg.CORSOrigins = os.Getenv("CORS_ORIGINS")
+
+	// prover arguments as JSON array with placeholders
+	cfg.ProverArgs = []string{"--out", "{out}"}
+	if v := os.Getenv("PROVER_ARGS"); v != "" {
+		if err := json.Unmarshal([]byte(v), &cfg.ProverArgs); err != nil {
+			return cfg, fmt.Errorf("invalid PROVER_ARGS: %w", err)
+		}
+	}
+
+	// extra prover arguments to verify and render a supplied derivation; disabled if empty
+	if v := os.Getenv("VERIFY_ARGS"); v != "" {
+		if err := json.Unmarshal([]byte(v), &cfg.VerifyArgs); err != nil {
+			return cfg, fmt.Errorf("invalid VERIFY_ARGS: %w", err)
+		}
+	}
+
+	// allow known placeholders only
+	placeholders := []string{"{out}", "{formula}", "{options}"}
+	for _, arg := range cfg.ProverArgs {
+		for _, p := range placeholderRegexp.FindAllString(arg, -1) {
+			if !slices.Contains(placeholders, p) {
+				return cfg, fmt.Errorf("unknown placeholder in PROVER_ARGS: %s", p)
+			}
+		}
+	}
+	placeholders = append(placeholders, "{derivation}")
+	for _, arg := range cfg.VerifyArgs {
+		for _, p := range placeholderRegexp.FindAllString(arg, -1) {
+			if !slices.Contains(placeholders, p) {
+				return cfg, fmt.Errorf("unknown placeholder in VERIFY_ARGS: %s", p)
+			}
+		}
+	}
+
+	return cfg, nil
+}
+
+// Redacted returns a copy of the config with secrets hidden.
+func (cfg Config) Redacted() Config {
+	if cfg.AdminToken != "" {
+		cfg.AdminToken = "REDACTED"
+	}
+	if cfg.SigningKey != "" {
+		cfg.SigningKey = "REDACTED"
+	}
+	return cfg
+}
+
+// envList reads a comma-separated environment variable, or returns nil if unset.
+func envList(name string) []string {
+	var list []string
+	for v := range strings.SplitSeq(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// envInt reads an integer environment variable, or returns def if unset.
+func envInt(name string, def int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return n, nil
 }
 
 func main() {
-	// fiber instance
-	app := fiber.New(fiber.Config{
+	// setup json logger
+	l := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	slog.SetDefault(l)
+
+	// load config
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// verify provers, and compile documents and templates
+	s, err := newServer(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// fail fast if temp directories cannot be created
+	if err := s.selfCheck(); err != nil {
+		log.Fatal(err)
+	}
+
+	// fiber instance with middlewares and routes
+	app := s.app()
+
+	// init port
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "3000"
+	}
+
+	// use localhost in dev environment
+	host := ""
+	if os.Getenv("ENV") == "dev" {
+		host = "localhost"
+	}
+
+	// stop background work on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// probe versions, which also warms up the binaries, then accept traffic
+	s.goBackground(func() { s.warmUp(ctx) })
+
+	// sweep old retained temp directories periodically
+	if cfg.RetainOnError {
+		s.goBackground(func() { s.sweepLoop(ctx, sweepInterval) })
+	}
+
+	// start server
+	log.Info("Starting server on port: ", port)
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- app.Listen(host + ":" + port)
+	}()
+	select {
+	case err := <-listenErr:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+
+	// shut down gracefully, refusing new requests
+	log.Info("Shutting down")
+	s.draining.Store(true)
+	// wait for requests, which end within the request timeout, plus a second to send responses
+	if err := app.ShutdownWithTimeout(cfg.RequestTimeout + time.Second); err != nil {
+		log.Error(err)
+	}
+	if s.stopBackground(shutdownGrace) {
+		log.Info("Background work stopped")
+	} else {
+		log.Error("Background work did not stop within shutdown timeout")
+	}
+}
+
+// newServer verifies the provers and compiles the documents and templates of the config.
+func newServer(cfg Config) (*Server, error) {
+	// compile request schema
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(requestSchema))
+	if err != nil {
+		return nil, err
+	}
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource("request.schema.json", doc); err != nil {
+		return nil, err
+	}
+	schema, err := compiler.Compile("request.schema.json")
+	if err != nil {
+		return nil, err
+	}
+
+	// build OpenAPI document with the request schema to keep them in sync
+	var openAPI map[string]any
+	if err := json.Unmarshal(openAPIBase, &openAPI); err != nil {
+		return nil, err
+	}
+	openAPI["components"].(map[string]any)["schemas"].(map[string]any)["Request"] = doc
+	openAPIDoc, err := json.Marshal(openAPI)
+	if err != nil {
+		return nil, err
+	}
+
+	// verify prover binaries, versions are probed on warm-up
+	provers := make(map[string]Prover)
+	for _, name := range cfg.Provers {
+		// setup prover path
+		p := name
+		if runtime.GOOS == "windows" {
+			p += "-windows.exe"
+		}
+		p = filepath.Join(".", "bin", p)
+
+		// fail fast if missing or not executable
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, fmt.Errorf("prover not found: %w", err)
+		}
+		if runtime.GOOS != "windows" && info.Mode()&0o111 == 0 {
+			return nil, fmt.Errorf("prover not executable: %s", p)
+		}
+
+		provers[name] = Prover{Path: p}
+		slog.Info("Prover found", "name", name, "path", p)
+	}
+
+	// parse explanation templates
+	explanations := make(map[string]*template.Template)
+	languages := []string{}
+	for lang, text := range cfg.ExplanationTemplates {
+		if explanations[lang], err = template.New("explanation-" + lang).Parse(text); err != nil {
+			return nil, fmt.Errorf("invalid EXPLANATION_TEMPLATES: %s: %w", lang, err)
+		}
+		languages = append(languages, lang)
+	}
+	slices.Sort(languages)
+	// register default template under its language, offered first to match wildcards
+	if cfg.ExplanationTemplate != "" {
+		if explanations[cfg.ExplanationLanguage], err = template.New("explanation").Parse(cfg.ExplanationTemplate); err != nil {
+			return nil, fmt.Errorf("invalid EXPLANATION_TEMPLATE: %w", err)
+		}
+		languages = slices.Insert(slices.DeleteFunc(languages, func(lang string) bool {
+			return lang == cfg.ExplanationLanguage
+		}), 0, cfg.ExplanationLanguage)
+	}
+
+	return &Server{
+		config:       cfg,
+		schema:       schema,
+		provers:      provers,
+		openAPI:      openAPIDoc,
+		apiVersion:   openAPI["info"].(map[string]any)["version"].(string),
+		explanations: explanations,
+		languages:    languages,
+		accessLog:    os.Stdout,
+		removeAll:    os.RemoveAll,
+	}, nil
+}
+
+// selfCheck checks the temp directory and logs a summary of the setup.
+func (s *Server) selfCheck() error {
+	// fail fast if temp directories cannot be created
+	dir, err := os.MkdirTemp(".", "tmp-")
+	if err != nil {
+		return fmt.Errorf("temp directory not writable: %w", err)
+	}
+	if err := os.Remove(dir); err != nil {
+		return err
+	}
+
+	// check free disk, not critical
+	free, err := freeDisk(".")
+	if err != nil {
+		log.Warn("Failed to check free disk: ", err)
+	}
+
+	// log self-check summary, with prover versions logged once warmed up
+	slog.Info("Self-check passed",
+		"config", s.config.Redacted(),
+		"free_disk", free,
+	)
+	return nil
+}
+
+// app builds the fiber app with middlewares and routes.
+func (s *Server) app() *fiber.App {
+	// fiber config
+	fiberConfig := fiber.Config{
 		// disable startup message
 		DisableStartupMessage: true,
-	})
+	}
+	// trust proxy headers only if sent by trusted proxies, see clientIP
+	if s.config.TrustedProxies != nil {
+		fiberConfig.EnableTrustedProxyCheck = true
+		fiberConfig.TrustedProxies = s.config.TrustedProxies
+	}
+
+	// fiber instance
+	app := fiber.New(fiberConfig)
 
 	// add middlewares
-	app.Use(recover.New())     // recover from panics
-	app.Use(helmet.New())      // security
-	app.Use(logger.New())      // logging
-	app.Use(compress.New())    // compression
-	app.Use(healthcheck.New()) // healthcheck at /livez
+	app.Use(recover.New()) // recover from panics
+	app.Use(helmet.New())  // security
+	// logging, with client IPs behind trusted proxies
+	app.Use(logger.New(logger.Config{
+		Output: s.accessLog,
+		CustomTags: map[string]logger.LogFunc{
+			logger.TagIP: func(output logger.Buffer, c *fiber.Ctx, _ *logger.Data, _ string) (int, error) {
+				return output.WriteString(s.clientIP(c))
+			},
+		},
+	}))
+	app.Use(requestid.New()) // request ID, reusing X-Request-ID from clients
+	// allow cross-origin clients if configured, exposing custom headers
+	if s.config.CORSOrigins != "" {
+		app.Use(cors.New(cors.Config{
+			AllowOrigins:  s.config.CORSOrigins,
+			ExposeHeaders: strings.Join(exposedHeaders, ","),
+		}))
+	}
 
-	// setup json logger
-	l := slog.New(slog.NewJSONHandler(os.Stdout, nil))
-	slog.SetDefault(l)
+	// advertise API version and enabled features
+	capabilities := s.capabilities(s.apiVersion)
+	app.Use(func(c *fiber.Ctx) error {
+		c.Set(headerCapabilities, capabilities)
+		return c.Next()
+	})
+
+	app.Use(compress.New(compress.Config{
+		Level: compress.Level(s.config.CompressLevel),
+	})) // compression
+	app.Use(func(c *fiber.Ctx) error {
+		if err := c.Next(); err != nil {
+			return err
+		}
+		// skip compression of small responses, since compress checks Accept-Encoding after handlers
+		if len(c.Response().Body()) < s.config.CompressMin {
+			c.Request().Header.Del(fiber.HeaderAcceptEncoding)
+		}
+		return nil
+	})
+	// sign final uncompressed body if configured, including error and replaced responses
+	if s.config.SigningKey != "" {
+		app.Use(func(c *fiber.Ctx) error {
+			if err := c.Next(); err != nil {
+				// render error now, since the error handler runs after middlewares
+				if err := c.App().ErrorHandler(c, err); err != nil {
+					return err
+				}
+			}
+			mac := hmac.New(sha256.New, []byte(s.config.SigningKey))
+			mac.Write(c.Response().Body())
+			c.Set(headerSignature, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+			return nil
+		})
+	}
+	app.Use(healthcheck.New(healthcheck.Config{
+		// not ready until warmed up, while draining, or if temp directories leak
+		ReadinessProbe: func(_ *fiber.Ctx) bool {
+			return s.ready.Load() && !s.draining.Load() && s.cleanupHealthy()
+		},
+	})) // healthcheck at /livez and /readyz
+
+	// refuse traffic until warmed up and while draining
+	app.Use(func(c *fiber.Ctx) error {
+		if s.draining.Load() {
+			c.Set(fiber.HeaderConnection, "close")
+			return sendRetry(c, fiber.StatusServiceUnavailable, "shutting down")
+		}
+		if !s.ready.Load() {
+			return sendRetry(c, fiber.StatusServiceUnavailable, "warming up")
+		}
+		return c.Next()
+	})
+
+	// limit total request duration
+	app.Use(func(c *fiber.Ctx) error {
+		ctx, cancel := context.WithTimeout(c.UserContext(), s.config.RequestTimeout)
+		defer cancel()
+		c.SetUserContext(ctx)
+		err := c.Next()
+		// replace response if request took too long
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			log.Warn("Request timeout")
+			// drop header describing the replaced response
+			c.Response().Header.Del(headerOutcome)
+			return sendRetry(c, fiber.StatusServiceUnavailable, "request timeout")
+		}
+		return err
+	})
+
+	// main API
+	app.Post("/", s.prove)
+	app.Post("/archive", s.proveArchive)
+
+	// API description
+	app.Get("/openapi.json", func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		return c.Send(s.openAPI)
+	})
+
+	// admin API, enabled only if token is set
+	if s.config.AdminToken != "" {
+		admin := app.Group("/admin", keyauth.New(keyauth.Config{
+			Validator: func(_ *fiber.Ctx, key string) (bool, error) {
+				return subtle.ConstantTimeCompare([]byte(key), []byte(s.config.AdminToken)) == 1, nil
+			},
+		}))
+		admin.Post("/warm", s.warm)
+		admin.Get("/config", func(c *fiber.Ctx) error {
+			return c.JSON(s.config.Redacted())
+		})
+		admin.Get("/runs", func(c *fiber.Ctx) error {
+			return c.JSON(s.recentRuns())
+		})
+		admin.Get("/cleanup", func(c *fiber.Ctx) error {
+			return c.JSON(s.cleanupStats())
+		})
+		admin.Post("/cleanup", func(c *fiber.Ctx) error {
+			removed, reclaimed := s.sweep()
+			return c.JSON(fiber.Map{"removed": removed, "reclaimed_bytes": reclaimed})
+		})
+	}
+
+	return app
+}
+
+// warmUp probes prover versions, which also loads the binaries, then accepts traffic.
+// It gives up without accepting traffic if ctx is done.
+func (s *Server) warmUp(ctx context.Context) {
+	for name, p := range s.provers {
+		version, err := probeVersion(ctx, p.Path)
+		// stop probing on shutdown
+		if ctx.Err() != nil {
+			log.Warn("Warm-up canceled: ", ctx.Err())
+			return
+		}
+		if err != nil {
+			log.Warn("Failed to probe prover version: ", err)
+		}
+		p.Version = version
+		s.provers[name] = p
+		slog.Info("Prover warmed up", "name", name, "version", version)
+	}
+	s.ready.Store(true)
+	// log probed versions
+	slog.Info("Ready", "provers", s.provers)
+}
+
+// probeVersion runs the prover with --version and returns its output.
+func probeVersion(ctx context.Context, p string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, versionTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, p, "--version").Output() // #nosec G204
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// warm proves a trivial formula with every prover to load it into the page cache.
+func (s *Server) warm(c *fiber.Ctx) error {
+	log.Info("Warming up provers")
+
+	// run each prover and measure duration
+	durations := make(map[string]int64)
+	start := time.Now()
+	for name, p := range s.provers {
+		t := time.Now()
+		if err := s.proveWarm(c.UserContext(), p.Path); err != nil {
+			log.Warn("Failed to warm up prover: ", err)
+		}
+		durations[name] = time.Since(t).Milliseconds()
+	}
+
+	return c.JSON(fiber.Map{
+		"duration_ms": time.Since(start).Milliseconds(),
+		"provers":     durations,
+	})
+}
+
+// proveWarm runs the prover once on warmFormula in a temp directory, as requests do.
+func (s *Server) proveWarm(ctx context.Context, prover string) error {
+	// use absolute path, so the prover does not depend on its working directory
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	tmpPath, err := os.MkdirTemp(cwd, "tmp-warm-")
+	if err != nil {
+		return err
+	}
+	// keep registered until removed, so the sweep skips it
+	tmp := filepath.Base(tmpPath)
+	s.active.Store(tmp, struct{}{})
+	defer s.active.Delete(tmp)
+	defer func() {
+		if err := os.RemoveAll(tmpPath); err != nil {
+			log.Error(err)
+			s.recordCleanupFailure()
+		}
+	}()
+
+	// write input files
+	if err := os.WriteFile(filepath.Join(tmpPath, "formula.txt"), []byte(warmFormula), 0400); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(tmpPath, "options.json"), []byte("{}"), 0400); err != nil {
+		return err
+	}
+
+	// run with the same arguments and environment as requests
+	ctx, cancel := context.WithTimeout(ctx, warmTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, prover, renderArgs(s.config.ProverArgs, tmpPath)...) // #nosec G204
+	cmd.Env = s.proverEnv()
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, out[:min(len(out), maxLoggedOutput)])
+	}
+	return nil
+}
+
+// renderArgs replaces placeholders in prover arguments with paths in the temp directory.
+func renderArgs(args []string, tmpPath string) []string {
+	replacer := strings.NewReplacer(
+		"{out}", tmpPath,
+		"{formula}", filepath.Join(tmpPath, "formula.txt"),
+		"{options}", filepath.Join(tmpPath, "options.json"),
+		"{derivation}", filepath.Join(tmpPath, "derivation.txt"),
+	)
+	rendered := make([]string, len(args))
+	for i, arg := range args {
+		rendered[i] = replacer.Replace(arg)
+	}
+	return rendered
+}
+
+// proverEnv returns the allowlisted environment of provers, or nil to inherit all.
+func (s *Server) proverEnv() []string {
+	if s.config.ProverEnv == nil {
+		return nil
+	}
+	env := []string{}
+	for _, name := range s.config.ProverEnv {
+		if v, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+v)
+		}
+	}
+	return env
+}
+
+// capabilities lists the API version and enabled features for clients.
+func (s *Server) capabilities(version string) string {
+	// always enabled
+	features := []string{"archive", "dedupe", "fields", "gzip_formula", "include_raw_result", "msgpack", "timeout_ms"}
+	// enabled by config
+	if _, ok := s.provers["prover-trace"]; ok {
+		features = append(features, "trace")
+	}
+	if s.config.TraceFallback {
+		features = append(features, "trace_fallback")
+	}
+	if s.config.PDFRenderer != "" {
+		features = append(features, "pdf")
+	}
+	if s.config.OutputFormats != nil {
+		features = append(features, "output_formats")
+	}
+	if s.config.ProverRules != nil {
+		features = append(features, "auto_detect")
+	}
+	if len(s.explanations) > 0 {
+		features = append(features, "explanation")
+	}
+	if s.config.SigningKey != "" {
+		features = append(features, "signing")
+	}
+	if s.config.StrictJSON {
+		features = append(features, "strict_json")
+	}
+	if s.config.UnprovableResults != nil {
+		features = append(features, "outcome_status")
+	}
+	if s.config.Preprocess != nil {
+		features = append(features, "preprocess")
+	}
+	if s.config.MaxComplexity > 0 {
+		features = append(features, "max_complexity")
+	}
+	if s.config.AdminToken != "" {
+		features = append(features, "admin")
+	}
+	if s.config.VerifyArgs != nil {
+		features = append(features, "verify")
+	}
+	slices.Sort(features)
+	return "api=" + version + "; features=" + strings.Join(features, ",")
+}
+
+// goBackground runs f in a background goroutine waited for on shutdown,
+// or synchronously once shutdown began, since the wait group must not grow while waited for.
+func (s *Server) goBackground(f func()) {
+	s.bgMu.Lock()
+	if s.bgStopped {
+		s.bgMu.Unlock()
+		f()
+		return
+	}
+	s.bg.Go(f)
+	s.bgMu.Unlock()
+}
+
+// stopBackground waits up to timeout for background goroutines, and reports whether they stopped.
+func (s *Server) stopBackground(timeout time.Duration) bool {
+	s.bgMu.Lock()
+	s.bgStopped = true
+	s.bgMu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.bg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// clientIP returns the rightmost address in the proxy header not of a trusted proxy,
+// since each proxy appends its peer and clients control the leftmost values.
+func (s *Server) clientIP(c *fiber.Ctx) string {
+	ip := c.IP()
+	if s.config.TrustedProxies == nil || !c.IsProxyTrusted() {
+		return ip
+	}
+	hops := strings.Split(c.Get(s.config.ProxyHeader), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		ip = addr.Unmap().String()
+		if !slices.ContainsFunc(s.config.trustedPrefixes, func(p netip.Prefix) bool { return p.Contains(addr.Unmap()) }) {
+			break
+		}
+	}
+	return ip
+}
+
+// recordRun keeps the run, dropping the oldest beyond RecentRuns.
+func (s *Server) recordRun(r runRecord) {
+	s.runsMu.Lock()
+	defer s.runsMu.Unlock()
+	s.runs = append(s.runs, r)
+	if len(s.runs) > s.config.RecentRuns {
+		s.runs = slices.Clone(s.runs[len(s.runs)-s.config.RecentRuns:])
+	}
+}
+
+// recentRuns returns the kept runs, newest first.
+func (s *Server) recentRuns() []runRecord {
+	s.runsMu.Lock()
+	defer s.runsMu.Unlock()
+	runs := append([]runRecord{}, s.runs...)
+	slices.Reverse(runs)
+	return runs
+}
+
+// recordCleanupFailure counts a failure to remove a temp directory.
+func (s *Server) recordCleanupFailure() {
+	s.cleanupMu.Lock()
+	defer s.cleanupMu.Unlock()
+	s.cleanupTotal++
+	s.cleanupFailures = append(s.cleanupFailures, time.Now())
+	slog.Warn("Cleanup failed", "total", s.cleanupTotal)
+}
+
+// cleanupHealthy reports whether recent cleanup failures are under the threshold, if any.
+func (s *Server) cleanupHealthy() bool {
+	s.cleanupMu.Lock()
+	defer s.cleanupMu.Unlock()
+	// drop failures out of window
+	s.cleanupFailures = slices.DeleteFunc(s.cleanupFailures, func(t time.Time) bool {
+		return time.Since(t) > cleanupWindow
+	})
+	return s.config.CleanupFailureThreshold == 0 || len(s.cleanupFailures) < s.config.CleanupFailureThreshold
+}
+
+// cleanupStats returns the total and recent counts of cleanup failures.
+func (s *Server) cleanupStats() fiber.Map {
+	s.cleanupMu.Lock()
+	defer s.cleanupMu.Unlock()
+	recent := 0
+	for _, t := range s.cleanupFailures {
+		if time.Since(t) <= cleanupWindow {
+			recent++
+		}
+	}
+	return fiber.Map{"failures_total": s.cleanupTotal, "recent_failures": recent}
+}
+
+// sweepLoop sweeps temp directories every interval until ctx is done.
+func (s *Server) sweepLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sweep()
+		}
+	}
+}
+
+// sweep removes temp directories older than the retention TTL,
+// returning the number of removed directories and reclaimed bytes.
+func (s *Server) sweep() (int, int64) {
+	dirs, err := filepath.Glob("tmp-*")
+	if err != nil {
+		log.Error(err)
+		return 0, 0
+	}
+	removed := 0
+	var reclaimed int64
+	for _, dir := range dirs {
+		// skip directories of running requests
+		if _, ok := s.active.Load(dir); ok {
+			continue
+		}
+		// skip recent directories, and ones younger than a request, which may be created
+		// but not yet registered
+		info, err := os.Stat(dir)
+		if err != nil || time.Since(info.ModTime()) < max(s.config.RetainTTL, s.config.RequestTimeout) {
+			continue
+		}
+		size := dirSize(dir)
+		if err := os.RemoveAll(dir); err != nil {
+			log.Error(err)
+			s.recordCleanupFailure()
+			continue
+		}
+		removed++
+		reclaimed += size
+	}
+	if removed > 0 {
+		log.Info("Swept temp directories: ", removed)
+	}
+	return removed, reclaimed
+}
+
+// dirSize returns the total size of regular files in dir.
+func dirSize(dir string) int64 {
+	var size int64
+	_ = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// mergeOptions deep-merges overrides into a copy of defaults.
+func mergeOptions(defaults, overrides map[string]any) map[string]any {
+	merged := make(map[string]any, len(defaults)+len(overrides))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		d, dok := merged[k].(map[string]any)
+		o, ook := v.(map[string]any)
+		if dok && ook {
+			merged[k] = mergeOptions(d, o)
+		} else {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// yamlDepth estimates the nesting depth of YAML content without parsing it,
+// from indentation levels, sequence dashes and flow brackets outside quotes.
+// It errs on overcounting, such as counting scalars as a level or brackets in block scalars.
+func yamlDepth(content []byte) int {
+	maxDepth := 0
+	flow := 0
+	var indents []int
+	for line := range bytes.Lines(content) {
+		line = bytes.TrimRight(line, "\r\n")
+		col := 0
+		// track block levels by indentation outside flow collections, each sequence dash opening one
+		if flow == 0 {
+			for col < len(line) && line[col] == ' ' {
+				col++
+			}
+			if col == len(line) || line[col] == '#' {
+				continue
+			}
+			for {
+				for len(indents) > 0 && indents[len(indents)-1] >= col {
+					indents = indents[:len(indents)-1]
+				}
+				indents = append(indents, col)
+				if line[col] != '-' || col+1 < len(line) && line[col+1] != ' ' {
+					break
+				}
+				col++
+				for col < len(line) && line[col] == ' ' {
+					col++
+				}
+				if col == len(line) {
+					break
+				}
+			}
+		}
+		// track flow brackets, skipping quoted scalars and comments
+		var quote byte
+		prev := byte(':')
+		for i := col; i < len(line); i++ {
+			ch := line[i]
+			switch {
+			case quote == '"' && ch == '\\':
+				i++
+			case quote != 0:
+				if ch == quote {
+					quote = 0
+				}
+			case (ch == '"' || ch == '\'') && strings.IndexByte(":,[{-?", prev) >= 0:
+				quote = ch
+			case ch == '#' && (i == 0 || line[i-1] == ' '):
+				i = len(line)
+			case ch == '[' || ch == '{':
+				flow++
+			case ch == ']' || ch == '}':
+				flow = max(flow-1, 0)
+			}
+			if ch != ' ' {
+				prev = ch
+			}
+			maxDepth = max(maxDepth, len(indents)+flow)
+		}
+		maxDepth = max(maxDepth, len(indents)+flow)
+	}
+	return maxDepth
+}
+
+// depth returns the nesting depth of objects and arrays in v.
+func depth(v any) int {
+	d := 0
+	switch v := v.(type) {
+	case map[string]any:
+		for _, e := range v {
+			d = max(d, depth(e))
+		}
+	case []any:
+		for _, e := range v {
+			d = max(d, depth(e))
+		}
+	default:
+		return 0
+	}
+	return d + 1
+}
+
+// decodeFormula decodes a gzip+base64 formula up to maxDecodedFormula bytes.
+func decodeFormula(encoded string) (string, error) {
+	zr, err := gzip.NewReader(base64.NewDecoder(base64.StdEncoding, strings.NewReader(encoded)))
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+	data, err := io.ReadAll(io.LimitReader(zr, maxDecodedFormula+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxDecodedFormula {
+		return "", errors.New("formula too large")
+	}
+	return string(data), nil
+}
+
+// checkStrict rejects unknown top-level fields and duplicate object keys.
+func checkStrict(body []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(new(Request)); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	return checkDuplicates(json.NewDecoder(bytes.NewReader(body)), "")
+}
+
+// checkDuplicates walks the next JSON value and rejects duplicate object keys.
+func checkDuplicates(dec *json.Decoder, path string) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch t {
+	case json.Delim('{'):
+		seen := make(map[string]bool)
+		for dec.More() {
+			t, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			key := t.(string)
+			if seen[key] {
+				return fmt.Errorf("duplicate key: %s/%s", path, key)
+			}
+			seen[key] = true
+			if err := checkDuplicates(dec, path+"/"+key); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+	case json.Delim('['):
+		for i := 0; dec.More(); i++ {
+			if err := checkDuplicates(dec, fmt.Sprintf("%s/%d", path, i)); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+	}
+	return err
+}
+
+// summaryValue quotes values that would break key=value parsing.
+func summaryValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// errTooLarge is returned when an encoded file exceeds its limit.
+var errTooLarge = errors.New("encoded file too large")
+
+// limitedBuilder is a string builder failing with errTooLarge beyond limit bytes.
+type limitedBuilder struct {
+	strings.Builder
+	limit int
+}
+
+// Write appends p unless the limit would be exceeded.
+func (b *limitedBuilder) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.limit {
+		return 0, errTooLarge
+	}
+	return b.Builder.Write(p)
+}
 
-	// main API
-	app.Post("/", prove)
+// encodeFile base64-encodes the file with bounded memory, up to limit bytes.
+func encodeFile(name string, limit int) (string, error) {
+	f, err := os.Open(name) // #nosec G304
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	encodedLen := base64.StdEncoding.EncodedLen(int(info.Size()))
+	// reject early by size, and mid-encode if the file grows
+	if encodedLen > limit {
+		return "", errTooLarge
+	}
+	b := &limitedBuilder{limit: limit}
+	b.Grow(encodedLen)
+	enc := base64.NewEncoder(base64.StdEncoding, b)
+	if _, err := io.Copy(enc, f); err != nil {
+		return "", err
+	}
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
 
-	// init port
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "3000"
+// project keeps only the given dot-separated field paths of the serialized value.
+func project(v any, fields []string) (map[string]any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var full map[string]any
+	if err := json.Unmarshal(data, &full); err != nil {
+		return nil, err
 	}
+	projected := make(map[string]any)
+	for _, field := range fields {
+		if field = strings.TrimSpace(field); field != "" {
+			copyPath(full, projected, strings.Split(field, "."))
+		}
+	}
+	return projected, nil
+}
 
-	// use localhost in dev environment
-	host := ""
-	if os.Getenv("ENV") == "dev" {
-		host = "localhost"
+// copyPath copies the value at path from src to dst, creating parent objects.
+func copyPath(src, dst map[string]any, path []string) {
+	v, ok := src[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		dst[path[0]] = v
+		return
 	}
+	sub, ok := v.(map[string]any)
+	if !ok {
+		return
+	}
+	parent, ok := dst[path[0]].(map[string]any)
+	if !ok {
+		parent = make(map[string]any)
+	}
+	copyPath(sub, parent, path[1:])
+	// omit parents of missing fields
+	if len(parent) > 0 {
+		dst[path[0]] = parent
+	}
+}
 
-	// start server
-	log.Info("Starting server on port: ", port)
-	log.Fatal(app.Listen(host + ":" + port))
+// sendRetry sends a 429/503 error with a jittered Retry-After hint for the first retry,
+// and exponential backoff parameters for later ones, so that clients do not retry all at once.
+func sendRetry(c *fiber.Ctx, status int, message string) error {
+	// random delay in [retryAfter, 2*retryAfter] seconds
+	delay := retryAfter + rand.IntN(retryAfter+1) // #nosec G404
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(delay))
+	return c.Status(status).JSON(fiber.Map{
+		"error":       message,
+		"retry_after": delay,
+		// retry n waits a random delay up to min(initial_s * multiplier^n, max_s)
+		"backoff": fiber.Map{
+			"initial_s":  retryAfter,
+			"multiplier": retryMultiplier,
+			"max_s":      retryMaxDelay,
+			"jitter":     "full",
+		},
+	})
 }
 
-func prove(c *fiber.Ctx) error {
-	log.Info("Request received")
+// prove runs the prover for the requested formula.
+func (s *Server) prove(c *fiber.Ctx) error {
+	slog.Info("Request received", "ip", s.clientIP(c))
 
 	// ==============================
 	// ==  Parse and Validate
 	// ==============================
 
+	// validate JSON body against schema
+	if c.Is("json") {
+		// reject duplicate and unknown keys in strict mode
+		if s.config.StrictJSON {
+			if err := checkStrict(c.Body()); err != nil {
+				log.Error(err)
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+			}
+		}
+		body, err := jsonschema.UnmarshalJSON(bytes.NewReader(c.Body()))
+		if err != nil {
+			log.Error(err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid JSON"})
+		}
+		if err := s.schema.Validate(body); err != nil {
+			log.Error(err)
+			// collect error paths
+			details := []fiber.Map{}
+			var ve *jsonschema.ValidationError
+			if errors.As(err, &ve) {
+				for _, e := range ve.BasicOutput().Errors {
+					if e.Error != nil {
+						details = append(details, fiber.Map{"path": e.InstanceLocation, "message": e.Error.String()})
+					}
+				}
+			}
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "schema violation", "details": details})
+		}
+	}
+
 	// init request
 	req := new(Request)
 
@@ -91,6 +1763,64 @@ func prove(c *fiber.Ctx) error {
 		return c.SendStatus(fiber.StatusBadRequest)
 	}
 
+	// reject missing or non-object options with a clear message, such as from form bodies
+	if req.Options == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "options must be a JSON object"})
+	}
+
+	// validate
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		log.Error(err)
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	slog.Info("Request parsed", "request", req)
+
+	return s.run(c, req)
+}
+
+// proveArchive runs the prover for formula.txt and options.json in a tar body.
+func (s *Server) proveArchive(c *fiber.Ctx) error {
+	slog.Info("Archive request received", "ip", s.clientIP(c))
+
+	// run options from query
+	req := &Request{
+		Timeout:   c.QueryInt("timeout"),
+		TimeoutMs: c.QueryInt("timeout_ms"),
+		Trace:     c.QueryBool("trace"),
+	}
+
+	// read input files, accepting only known names
+	tr := tar.NewReader(bytes.NewReader(c.Body()))
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			log.Error(err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid archive"})
+		}
+		name := path.Clean(h.Name)
+		if h.Typeflag != tar.TypeReg || (name != "formula.txt" && name != "options.json") {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "unexpected entry in archive: " + h.Name})
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, maxDecodedFormula+1))
+		if err != nil {
+			log.Error(err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid archive"})
+		}
+		if len(data) > maxDecodedFormula {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": name + " too large"})
+		}
+		if name == "formula.txt" {
+			req.Formula = string(data)
+		} else if err := json.Unmarshal(data, &req.Options); err != nil {
+			log.Error(err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid options.json"})
+		}
+	}
+
 	// validate
 	validate := validator.New()
 	if err := validate.Struct(req); err != nil {
@@ -99,39 +1829,176 @@ func prove(c *fiber.Ctx) error {
 	}
 	slog.Info("Request parsed", "request", req)
 
+	return s.run(c, req)
+}
+
+// run runs the prover for a validated request and sends the response.
+func (s *Server) run(c *fiber.Ctx, req *Request) error {
+	// reject conflicting or incomplete field combinations
+	if err := checkFields(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// decode compressed formula
+	if req.Encoding == "gzip+base64" {
+		formula, err := decodeFormula(req.Formula)
+		if err != nil {
+			log.Error(err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid encoded formula: " + err.Error()})
+		}
+		req.Formula = formula
+	}
+
+	// preprocess formula
+	for _, name := range s.config.Preprocess {
+		req.Formula, _ = preprocess(name, req.Formula)
+	}
+	if req.Formula == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "formula is empty after preprocessing"})
+	}
+
+	// reject formulas that would obviously time out, counting connectives and quantifiers
+	if s.config.MaxComplexity > 0 {
+		complexity := 0
+		for _, token := range s.config.ComplexityTokens {
+			complexity += strings.Count(req.Formula, token)
+		}
+		if complexity > s.config.MaxComplexity {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("formula too complex: %d connectives and quantifiers, max %d", complexity, s.config.MaxComplexity),
+			})
+		}
+	}
+
+	// reject PDF rendering if not enabled
+	if req.Render == "pdf" && s.config.PDFRenderer == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "PDF rendering is disabled"})
+	}
+
+	// select prover, detected from formula if requested
+	base := "prover"
+	if req.AutoDetect {
+		for _, rule := range s.config.ProverRules {
+			if rule.regexp.MatchString(req.Formula) {
+				base = rule.Prover
+				break
+			}
+		}
+	}
+	name := base
+	if req.Trace {
+		name += "-trace"
+	}
+	p, ok := s.provers[name]
+	if !ok {
+		log.Error("Prover not available: ", name)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "prover not available: " + name})
+	}
+	prover := p.Path
+
+	// reject deeply nested options
+	if s.config.MaxOptionsDepth > 0 && depth(req.Options) > s.config.MaxOptionsDepth {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("options nested deeper than %d", s.config.MaxOptionsDepth)})
+	}
+
+	// reject verify mode if not enabled
+	if req.Verify && s.config.VerifyArgs == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "verify mode is disabled"})
+	}
+	// input files, kept on fallback and never returned
+	inputs := []string{"formula.txt", "options.json"}
+	if req.Verify {
+		inputs = append(inputs, "derivation.txt")
+	}
+
+	// map output formats to prover flags
+	formatArgs := []string{}
+	for _, format := range req.OutputFormats {
+		flag, ok := s.config.OutputFormats[format]
+		if !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "unsupported output format: " + format})
+		}
+		formatArgs = append(formatArgs, flag)
+	}
+
 	// ==============================
 	// ==  Temp directory and files
 	// ==============================
 
-	// tmp directory
-	tmpPath, err := os.MkdirTemp(".", "tmp-")
+	// tmp directory, named after sanitized request ID for correlation
+	prefix := "tmp-"
+	if id, ok := c.Locals("requestid").(string); ok {
+		if id = unsafeNameRegexp.ReplaceAllString(id, ""); id != "" {
+			prefix += id[:min(len(id), maxRequestIDName)] + "-"
+		}
+	}
+	// use absolute path, so the prover does not depend on its working directory
+	cwd, err := os.Getwd()
+	if err != nil {
+		log.Error(err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	tmpPath, err := os.MkdirTemp(cwd, prefix)
 	if err != nil {
 		log.Error(err)
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 	tmp := filepath.Base(tmpPath)
+	s.active.Store(tmp, struct{}{})
 
-	// cleanup
+	// cleanup in background, unless retained for debugging
+	retain := false
 	defer func() {
-		if err := os.RemoveAll(tmp); err != nil {
-			log.Error(err)
+		if retain {
+			s.active.Delete(tmp)
+			log.Warn("Retained temp directory: ", tmpPath)
+			return
 		}
+		// keep registered until removed, so the sweep skips it
+		s.goBackground(func() {
+			defer s.active.Delete(tmp)
+			if err := s.removeAll(tmpPath); err != nil {
+				log.Error(err)
+				s.recordCleanupFailure()
+			}
+		})
 	}()
 
 	// write formula to file
-	if err := os.WriteFile(filepath.Join(tmp, "formula.txt"), []byte(req.Formula), 0400); err != nil {
+	if err := os.WriteFile(filepath.Join(tmpPath, "formula.txt"), []byte(req.Formula), 0400); err != nil {
 		log.Error(err)
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 
-	// convert options to JSON string
-	options, err := json.MarshalIndent(req.Options, "", "  ")
-	if err != nil {
-		log.Error(err)
-		return c.SendStatus(fiber.StatusInternalServerError)
+	// write derivation to file in verify mode
+	if req.Verify {
+		if err := os.WriteFile(filepath.Join(tmpPath, "derivation.txt"), []byte(req.Derivation), 0400); err != nil {
+			log.Error(err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+	}
+
+	// write options merged with default options of the current prover, request values winning;
+	// rewritten on fallback to another prover
+	var proverOptions map[string]any
+	writeOptions := func() error {
+		proverOptions = req.Options
+		if defaults, ok := s.config.ProverDefaultOptions[name]; ok {
+			proverOptions = mergeOptions(defaults, req.Options)
+		}
+		// convert options to JSON string
+		options, err := json.MarshalIndent(proverOptions, "", "  ")
+		if err != nil {
+			return err
+		}
+		// replace read-only file of previous prover
+		path := filepath.Join(tmpPath, "options.json")
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return os.WriteFile(path, options, 0400)
 	}
-	// write options to file
-	if err := os.WriteFile(filepath.Join(tmp, "options.json"), options, 0400); err != nil {
+	if err := writeOptions(); err != nil {
 		log.Error(err)
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
@@ -140,38 +2007,204 @@ func prove(c *fiber.Ctx) error {
 	// ==  Execute prover
 	// ==============================
 
-	// context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(req.Timeout)*time.Second)
+	// context with timeout, bounded by the request context
+	// use millisecond timeout if given
+	limit := time.Duration(req.Timeout) * time.Second
+	if req.TimeoutMs > 0 {
+		limit = time.Duration(req.TimeoutMs) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(c.UserContext(), limit)
 	defer cancel()
 
-	// setup prover path
-	prover := "prover"
-	if req.Trace {
-		prover += "-trace"
-	}
-	if runtime.GOOS == "windows" {
-		prover += "-windows.exe"
+	// render prover arguments
+	args := append(renderArgs(s.config.ProverArgs, tmpPath), formatArgs...)
+	// verify supplied derivation instead of searching
+	if req.Verify {
+		args = append(args, renderArgs(s.config.VerifyArgs, tmpPath)...)
 	}
-	prover = filepath.Join(".", "bin", prover)
 
-	// execute prover
-	log.Info("Proving..")
-	cmd := exec.CommandContext(ctx, prover, "--out", tmp) // #nosec G204
-	stdout, err := cmd.CombinedOutput()
+	// state of the last prover run
+	var (
+		cmd         *exec.Cmd
+		stdout      []byte
+		timeout     bool
+		failed      bool
+		killed      string
+		truncated   bool
+		exceeded    bool
+		proverTime  time.Duration
+		traceErr    error
+		traceStdout []byte
+	)
+	for {
+		// execute prover
+		log.Info("Proving..")
+		runCtx, runCancel := context.WithCancel(ctx)
+		cmd = exec.CommandContext(runCtx, prover, args...) // #nosec G204
+		// pass only allowlisted environment variables if configured
+		cmd.Env = s.proverEnv()
+		// capture stdout and stderr together
+		var output bytes.Buffer
+		cmd.Stdout = &output
+		// also log output in real time if configured
+		lines := &lineLogger{}
+		if s.config.StreamLogs {
+			cmd.Stdout = io.MultiWriter(&output, lines)
+		}
+		// limit output lines if configured
+		var limiter *lineLimiter
+		if s.config.MaxStdoutLines > 0 {
+			limiter = &lineLimiter{w: cmd.Stdout, max: s.config.MaxStdoutLines}
+			if s.config.StdoutLimitCancel {
+				limiter.onLimit = runCancel
+			}
+			cmd.Stdout = limiter
+		}
+		// stop prover on output budget if configured
+		var budget *byteLimiter
+		if s.config.MaxOutputBytes > 0 {
+			budget = &byteLimiter{w: cmd.Stdout, max: s.config.MaxOutputBytes, onLimit: runCancel}
+			cmd.Stdout = budget
+		}
+		cmd.Stderr = cmd.Stdout
+		// size of input files, not counted as output
+		inputSize := dirSize(tmpPath)
+		var filesExceeded atomic.Bool
+		started := time.Now()
+		err = cmd.Start()
+		if err == nil {
+			// lower priority of prover if configured
+			if s.config.ProverNice != 0 {
+				if err := setNice(cmd.Process.Pid, s.config.ProverNice); err != nil {
+					log.Warn("Failed to set nice: ", err)
+				}
+			}
+			// limit open files of prover if configured
+			if s.config.ProverMaxFiles > 0 {
+				if err := setMaxFiles(cmd.Process.Pid, s.config.ProverMaxFiles); err != nil {
+					log.Warn("Failed to set file limit: ", err)
+				}
+			}
+			// stop prover on output budget of files too, polled since the prover writes them directly
+			polled := make(chan struct{})
+			if s.config.MaxOutputBytes == 0 {
+				close(polled)
+			} else {
+				go func() {
+					defer close(polled)
+					ticker := time.NewTicker(outputPollInterval)
+					defer ticker.Stop()
+					for {
+						select {
+						case <-runCtx.Done():
+							return
+						case <-ticker.C:
+							if dirSize(tmpPath)-inputSize > int64(s.config.MaxOutputBytes) {
+								filesExceeded.Store(true)
+								runCancel()
+								return
+							}
+						}
+					}
+				}()
+			}
+			err = cmd.Wait()
+			runCancel()
+			<-polled
+		}
+		runCancel()
+		proverTime += time.Since(started)
+		lines.Flush()
+		stdout = output.Bytes()
+		truncated = limiter != nil && limiter.truncated
+		exceeded = (budget != nil && budget.exceeded) || filesExceeded.Load()
 
-	// check if timed out
-	timeout := errors.Is(ctx.Err(), context.DeadlineExceeded)
+		// check if timed out
+		timeout = errors.Is(ctx.Err(), context.DeadlineExceeded)
+		// check if failed
+		failed = err != nil
+		// check if killed by others, such as OOM killer, not by timeout
+		killed = ""
+		if failed && !timeout && !exceeded && !(truncated && s.config.StdoutLimitCancel) && cmd.ProcessState != nil {
+			ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+			if (ok && ws.Signaled() && ws.Signal() == syscall.SIGKILL) || cmd.ProcessState.ExitCode() == 137 {
+				killed = cmd.ProcessState.String()
+			}
+		}
 
-	// log result
-	switch {
-	case timeout:
-		log.Warn("Timeout")
-	case err != nil:
-		log.Error(err)
-	default:
-		log.Info("Done")
+		hash := sha256.Sum256([]byte(req.Formula))
+
+		// keep run for post-mortem if configured
+		if s.config.RecentRuns > 0 {
+			out := string(stdout)
+			if len(out) > maxLoggedOutput {
+				out = out[:maxLoggedOutput]
+			}
+			s.recordRun(runRecord{
+				Time:        started,
+				Prover:      name,
+				ExitCode:    cmd.ProcessState.ExitCode(),
+				Timeout:     timeout,
+				DurationMs:  time.Since(started).Milliseconds(),
+				FormulaHash: hex.EncodeToString(hash[:]),
+				Output:      out,
+			})
+		}
+
+		// log result
+		switch {
+		case timeout:
+			log.Warn("Timeout")
+		case failed:
+			// log size-limited output for debugging
+			out := string(stdout)
+			if len(out) > maxLoggedOutput {
+				out = out[:maxLoggedOutput]
+			}
+			slog.Error("Prover failed",
+				"error", err,
+				"exit_code", cmd.ProcessState.ExitCode(),
+				"output", out,
+				"formula_hash", hex.EncodeToString(hash[:]),
+			)
+		default:
+			log.Info("Done")
+		}
+
+		// retry with non-trace prover only if trace prover failed and fallback is enabled
+		fallback, ok := s.provers[base]
+		if !failed || timeout || name != base+"-trace" || !s.config.TraceFallback || !ok {
+			break
+		}
+		log.Warn("Falling back to non-trace prover")
+		traceErr, traceStdout = err, stdout
+		name, prover = base, fallback.Path
+
+		// remove outputs of trace prover, keeping input files
+		entries, err := os.ReadDir(tmpPath)
+		if err != nil {
+			log.Error(err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		for _, e := range entries {
+			if slices.Contains(inputs, e.Name()) {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(tmpPath, e.Name())); err != nil {
+				log.Error(err)
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+		// merge default options of non-trace prover instead
+		if err := writeOptions(); err != nil {
+			log.Error(err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
 	}
 
+	// retain temp directory if failed or timed out
+	retain = s.config.RetainOnError && (failed || timeout)
+
 	// ==============================
 	// ==  Setup Result
 	// ==============================
@@ -179,17 +2212,103 @@ func prove(c *fiber.Ctx) error {
 	// init response
 	response := new(Response)
 
-	// read result.yaml
-	content, err := os.ReadFile(filepath.Join(tmp, "result.yaml")) // #nosec G304
-	if err != nil {
+	// check if temp directory was removed during the request
+	if _, err := os.Stat(tmpPath); errors.Is(err, fs.ErrNotExist) {
+		log.Error("Temp directory vanished: ", tmp)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "temp directory was removed during the request"})
+	}
+
+	// check size of result.yaml before reading
+	var content []byte
+	info, err := os.Stat(filepath.Join(tmpPath, "result.yaml"))
+	switch {
+	case (exceeded || killed != "" || timeout) && errors.Is(err, fs.ErrNotExist):
+		// prover stopped at output budget, killed or timed out before writing result; treat as empty,
+		// so the reason reaches the client
+	case err != nil:
 		log.Error(err)
 		return c.SendStatus(fiber.StatusInternalServerError)
+	case info.Size() > int64(s.config.ResultMaxSize):
+		log.Error("Result too large: ", info.Size())
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "result.yaml too large"})
+	default:
+		// read result.yaml
+		content, err = os.ReadFile(filepath.Join(tmpPath, "result.yaml")) // #nosec G304
+		if err != nil {
+			log.Error(err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+	}
+	// strip BOM and replace invalid UTF-8, which provers may print
+	content = bytes.TrimPrefix(content, []byte("\ufeff"))
+	if !utf8.Valid(content) {
+		log.Warn("Invalid UTF-8 in result.yaml")
+		content = bytes.ToValidUTF8(content, []byte("\ufffd"))
+	}
+	// reject deep nesting before parsing, since the parser is slow and memory hungry on it
+	if yamlDepth(content) > maxResultDepth {
+		log.Error("Result nested too deeply")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "result.yaml nested too deeply"})
+	}
+	// reject aliases, since shared values expand exponentially in JSON
+	file, err := parser.ParseBytes(content, 0)
+	if err != nil {
+		log.Error(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "result.yaml is not valid YAML"})
+	}
+	for _, doc := range file.Docs {
+		// skip empty documents
+		if doc.Body == nil {
+			continue
+		}
+		if len(ast.Filter(ast.AliasType, doc.Body)) > 0 {
+			log.Error("Result contains YAML aliases")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "result.yaml must not contain aliases"})
+		}
 	}
 	// parse YAML
 	if err := yaml.Unmarshal(content, &response.Result); err != nil {
 		log.Error(err)
-		return c.SendStatus(fiber.StatusInternalServerError)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "result.yaml is not valid YAML"})
+	}
+	// treat empty result.yaml as empty result
+	if response.Result == nil {
+		response.Result = make(map[string]any)
+	}
+	// drop unknown keys in strict policy, keeping typed fields
+	if s.config.ResultKeyPolicy == "strict" {
+		for key := range response.Result {
+			if key != "warnings" && key != "timings" && !slices.Contains(s.config.ResultKeys, key) {
+				slog.Warn("Dropped unknown result key", "key", key)
+				delete(response.Result, key)
+			}
+		}
+	}
+
+	// move warnings to typed field, always present for clients
+	response.Warnings = []string{}
+	if warnings, ok := response.Result["warnings"].([]any); ok {
+		for _, w := range warnings {
+			response.Warnings = append(response.Warnings, fmt.Sprint(w))
+		}
+	}
+	delete(response.Result, "warnings")
+
+	// move phase timings to typed field, if reported
+	if timings, ok := response.Result["timings"].(map[string]any); ok {
+		response.Timings = make(map[string]float64)
+		for phase, v := range timings {
+			switch v := v.(type) {
+			case uint64:
+				response.Timings[phase] = float64(v)
+			case int64:
+				response.Timings[phase] = float64(v)
+			case float64:
+				response.Timings[phase] = v
+			}
+		}
 	}
+	delete(response.Result, "timings")
 
 	// add stdout if not empty
 	if s := string(stdout); s != "" {
@@ -199,6 +2318,74 @@ func prove(c *fiber.Ctx) error {
 	if timeout {
 		response.Result["timeout"] = true
 	}
+	// add flag if output was cut at MAX_STDOUT_LINES
+	if truncated {
+		response.Result["stdout_truncated"] = true
+	}
+	// add flag if prover was stopped at MAX_OUTPUT_BYTES
+	if exceeded {
+		response.Result["output_limit_exceeded"] = true
+	}
+	// add flag if prover likely failed on PROVER_MAX_FILES
+	if failed && s.config.ProverMaxFiles > 0 && bytes.Contains(bytes.ToLower(stdout), []byte("too many open files")) {
+		response.Result["file_limit_exceeded"] = true
+	}
+	// add reason if killed, to tell resource exhaustion from other errors
+	if killed != "" {
+		response.Result["killed"] = killed
+	}
+	// add transforms applied to formula
+	if s.config.Preprocess != nil {
+		response.Result["preprocess"] = s.config.Preprocess
+	}
+	// add prover name for debugging
+	response.Result["prover"] = name
+	// add temp directory name to map reports to retained artifacts
+	if s.config.IncludeRunID {
+		response.Result["run_id"] = tmp
+	}
+	// add resource usage of last prover run for performance analysis
+	if s.config.IncludeUsage && cmd.ProcessState != nil {
+		usage := map[string]any{
+			"user_time_ms":   cmd.ProcessState.UserTime().Milliseconds(),
+			"system_time_ms": cmd.ProcessState.SystemTime().Milliseconds(),
+		}
+		if rss, ok := maxRSS(cmd.ProcessState); ok {
+			usage["max_rss_bytes"] = rss
+		}
+		response.Result["usage"] = usage
+	}
+	// add human-readable explanation of result in preferred language if configured
+	lang := s.config.ExplanationLanguage
+	if len(s.languages) > 0 && c.Get(fiber.HeaderAcceptLanguage) != "" {
+		lang = cmp.Or(c.AcceptsLanguages(s.languages...), lang)
+	}
+	if t, ok := s.explanations[lang]; ok {
+		var b strings.Builder
+		if err := t.Execute(&b, response.Result); err != nil {
+			log.Warn("Failed to render explanation: ", err)
+		} else {
+			response.Result["explanation"] = b.String()
+		}
+	}
+	// add command for reproducibility, keeping placeholders to hide server paths
+	if s.config.IncludeCommand {
+		command := slices.Concat([]string{name}, s.config.ProverArgs, formatArgs)
+		if req.Verify {
+			command = append(command, s.config.VerifyArgs...)
+		}
+		response.Result["command"] = command
+		// options as seen by the prover, with defaults merged
+		response.Result["command_options"] = proverOptions
+	}
+	// keep error of trace prover if fallen back
+	if traceErr != nil {
+		response.Result["trace_failed"] = true
+		response.Result["trace_error"] = traceErr.Error()
+		if out := string(traceStdout); out != "" {
+			response.Result["trace_stdout"] = out
+		}
+	}
 
 	// ==============================
 	// ==  Setup Files
@@ -207,50 +2394,272 @@ func prove(c *fiber.Ctx) error {
 	// init files
 	response.Files = make(map[string]map[string]string)
 
-	// read files from tmp directory
-	files, err := os.ReadDir(tmp)
-	if err != nil {
-		log.Error(err)
-		return c.SendStatus(fiber.StatusInternalServerError)
+	// file collected from tmp directory
+	type outputFile struct {
+		ext, base, content string
+		requested          bool
 	}
+	var collected []outputFile
+
+	// walk tmp directory to collect nested files too
+	err = filepath.WalkDir(tmpPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// get slash-separated path relative to tmp directory
+		rel, err := filepath.Rel(tmpPath, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
 
-	// process each file in tmp directory
-	for _, f := range files {
-		// get filename
-		filename := f.Name()
+		// skip too deep directories
+		if d.IsDir() {
+			if rel != "." && strings.Count(rel, "/")+1 > maxOutputDepth {
+				log.Warn("Skipped deep directory: ", rel)
+				return filepath.SkipDir
+			}
+			return nil
+		}
 
-		// skip input/result files
-		switch filename {
-		case "formula.txt", "options.json", "result.yaml":
-			continue
+		// skip symlinks, which may point outside tmp directory, and other non-regular files
+		if !d.Type().IsRegular() {
+			log.Warn("Skipped non-regular file: ", rel)
+			return nil
+		}
+
+		// skip input files, and result file unless requested
+		if slices.Contains(inputs, rel) || (rel == "result.yaml" && !req.IncludeRawResult) {
+			return nil
 		}
 
 		// read file
-		bytes, err := os.ReadFile(filepath.Join(tmp, filename)) // #nosec G304
+		data, err := os.ReadFile(p) // #nosec G304
 		if err != nil {
 			log.Error(err)
 			// skip
-			continue
+			return nil
 		}
 
 		// skip empty files
-		content := string(bytes)
+		content := string(data)
 		if content == "" {
-			continue
+			return nil
 		}
 
-		// split filename into base and extension
+		// split filename into base and extension, keeping the directory in base
+		dir, filename := path.Split(rel)
 		base, ext, _ := strings.Cut(filename, ".")
+		base = dir + base
+
+		// transform file if configured, keeping original on error
+		if name, ok := s.config.FileTransforms[ext]; ok {
+			if t, err := transformFile(name, content); err != nil {
+				log.Warn("Failed to transform file: ", rel, ": ", err)
+			} else {
+				content = t
+			}
+		}
+
+		// collect file
+		collected = append(collected, outputFile{ext: ext, base: base, content: content, requested: rel == "result.yaml"})
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Error("Temp directory vanished: ", tmp)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "temp directory was removed during the request"})
+	}
+	if err != nil {
+		log.Error(err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	// add requested files first, then smaller files first to fit more files in the budget
+	slices.SortStableFunc(collected, func(a, b outputFile) int {
+		if a.requested != b.requested {
+			if a.requested {
+				return -1
+			}
+			return 1
+		}
+		return len(a.content) - len(b.content)
+	})
+
+	// total bytes of files in response
+	size := 0
+	for _, f := range collected {
+		// skip files over budget
+		if s.config.MaxResponseSize > 0 && size+len(f.content) > s.config.MaxResponseSize {
+			log.Warn("Response truncated")
+			response.Result["response_truncated"] = true
+			continue
+		}
+		size += len(f.content)
 
 		// check if extension map exists
-		if _, ok := response.Files[ext]; !ok {
-			response.Files[ext] = make(map[string]string)
+		if _, ok := response.Files[f.ext]; !ok {
+			response.Files[f.ext] = make(map[string]string)
 		}
 
 		// add to files
-		response.Files[ext][base] = content
+		response.Files[f.ext][f.base] = f.content
+	}
+
+	// ==============================
+	// ==  Render PDF
+	// ==============================
+
+	// compile LaTeX files to PDF if requested
+	if req.Render == "pdf" {
+		// render in another directory to keep LaTeX by-products out of files,
+		// named as temp directory so the sweep removes it after crashes
+		pdfDir, err := os.MkdirTemp(cwd, "tmp-pdf-")
+		if err != nil {
+			log.Error(err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		pdfTmp := filepath.Base(pdfDir)
+		s.active.Store(pdfTmp, struct{}{})
+		defer s.active.Delete(pdfTmp)
+		defer func() {
+			if err := os.RemoveAll(pdfDir); err != nil {
+				log.Error(err)
+				s.recordCleanupFailure()
+			}
+		}()
+
+		// pass the prover environment, or only PATH and HOME, keeping server secrets from LaTeX
+		env := s.proverEnv()
+		if env == nil {
+			env = []string{}
+			for _, name := range []string{"PATH", "HOME"} {
+				if v, ok := os.LookupEnv(name); ok {
+					env = append(env, name+"="+v)
+				}
+			}
+		}
+		// restrict file access to the temp and output directories, since sources derive from client formulas
+		env = append(env, "openin_any=p", "openout_any=p", "TEXMFOUTPUT="+pdfDir)
+
+		for base := range response.Files["tex"] {
+			// run LaTeX within the request deadline, without shell escape
+			log.Info("Rendering PDF: ", base)
+			cmd := exec.CommandContext(c.UserContext(), s.config.PDFRenderer, // #nosec G204
+				"-no-shell-escape", "-interaction=nonstopmode", "-halt-on-error", "-output-directory="+pdfDir,
+				filepath.FromSlash(base)+".tex",
+			)
+			cmd.Dir = tmpPath
+			cmd.Env = env
+			if out, err := cmd.CombinedOutput(); err != nil {
+				log.Warn("Failed to render PDF: ", err, "\n", string(out))
+				// skip
+				continue
+			}
+
+			// encode as base64 since PDF is binary, stopping at remaining budget
+			limit := math.MaxInt
+			if s.config.MaxResponseSize > 0 {
+				limit = max(s.config.MaxResponseSize-size, 0)
+			}
+			content, err := encodeFile(filepath.Join(pdfDir, path.Base(base)+".pdf"), limit)
+			// skip if over budget
+			if errors.Is(err, errTooLarge) {
+				log.Warn("Response truncated")
+				response.Result["response_truncated"] = true
+				continue
+			}
+			if err != nil {
+				log.Error(err)
+				// skip
+				continue
+			}
+			size += len(content)
+
+			// check if extension map exists
+			if _, ok := response.Files["pdf"]; !ok {
+				response.Files["pdf"] = make(map[string]string)
+			}
+
+			// add to files
+			response.Files["pdf"][base] = content
+		}
+	}
+
+	// replace file contents with hashes of shared blobs if requested
+	if req.Dedupe {
+		response.Blobs = make(map[string]string)
+		for _, ext := range response.Files {
+			for base, content := range ext {
+				hash := sha256.Sum256([]byte(content))
+				key := hex.EncodeToString(hash[:])
+				response.Blobs[key] = content
+				ext[base] = key
+			}
+		}
+	}
+
+	// summarize outcome for clients reading headers only
+	outcome := "done"
+	switch {
+	case timeout:
+		outcome = "timeout"
+	case failed:
+		outcome = "error"
+	case slices.Contains(s.config.UnprovableResults, fmt.Sprint(response.Result["result"])):
+		outcome = "unprovable"
+	}
+	c.Set(headerOutcome, outcome)
+
+	// add stable one-line summary, such as outcome=done result=provable steps=7 prover=prover dur=812ms
+	if s.config.IncludeSummary {
+		parts := []string{"outcome=" + outcome}
+		for _, key := range []string{"result", "steps"} {
+			if v, ok := response.Result[key]; ok {
+				parts = append(parts, key+"="+summaryValue(fmt.Sprint(v)))
+			}
+		}
+		parts = append(parts, "prover="+name, fmt.Sprintf("dur=%dms", proverTime.Milliseconds()))
+		response.Summary = strings.Join(parts, " ")
+	}
+
+	// encode unprovable outcome in status if client opts in
+	if strings.Contains(c.Get("Prefer"), "outcome-status") && outcome == "unprovable" {
+		c.Status(fiber.StatusUnprocessableEntity)
+	}
+
+	// add server overhead beyond prover runs, excluding encoding below
+	response.Result["overhead_ms"] = (time.Since(c.Context().Time()) - proverTime).Milliseconds()
+
+	// project to requested fields, if any
+	var body any = response
+	if fields := c.Query("fields"); fields != "" {
+		projected, err := project(response, strings.Split(fields, ","))
+		if err != nil {
+			log.Error(err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		body = projected
+	}
+
+	// encode as MessagePack if requested, otherwise JSON
+	if c.Accepts(fiber.MIMEApplicationJSON, mimeMsgpack) == mimeMsgpack {
+		var buf bytes.Buffer
+		enc := msgpack.NewEncoder(&buf)
+		// reuse json field names
+		enc.SetCustomStructTag("json")
+		if err := enc.Encode(body); err != nil {
+			log.Error(err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		c.Set(fiber.HeaderContentType, mimeMsgpack)
+		if err := c.Send(buf.Bytes()); err != nil {
+			return err
+		}
+	} else if err := c.JSON(body); err != nil {
+		return err
 	}
 
 	// return response
-	return c.JSON(response)
+	return nil
 }
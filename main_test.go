@@ -0,0 +1,1494 @@
+//go:build linux
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// TestMain runs tests in a temp directory with the stub prover and LaTeX command in bin.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "prover-test-")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "bin"), 0o755); err != nil {
+		panic(err)
+	}
+	for name, stub := range map[string]string{"prover": "prover.sh", "prover-trace": "prover.sh", "latex": "latex.sh"} {
+		data, err := os.ReadFile(filepath.Join("testdata", stub))
+		if err != nil {
+			panic(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "bin", name), data, 0o755); err != nil { // #nosec G306
+			panic(err)
+		}
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testResponse is a response body or an error body.
+type testResponse struct {
+	Response
+
+	Error string `json:"error"`
+}
+
+// newTestServer returns a warmed-up server configured by environment name and value pairs.
+func newTestServer(t *testing.T, env ...string) *Server {
+	t.Helper()
+	for i := 0; i < len(env); i += 2 {
+		t.Setenv(env[i], env[i+1])
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ready.Store(true)
+	// wait for background cleanup of temp directories
+	t.Cleanup(s.bg.Wait)
+	return s
+}
+
+// do sends a request with header name and value pairs to the app.
+func do(t *testing.T, app *fiber.App, method, target, body string, header ...string) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	}
+	for i := 0; i < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	// wait for slow provers instead of the default 1s
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	return resp
+}
+
+// prove posts the JSON body to the app and decodes the response.
+func prove(t *testing.T, app *fiber.App, body string, header ...string) (*http.Response, testResponse) {
+	t.Helper()
+	resp := do(t, app, fiber.MethodPost, "/", body, header...)
+	var res testResponse
+	// skip bare status responses
+	if !strings.HasPrefix(resp.Header.Get(fiber.HeaderContentType), fiber.MIMEApplicationJSON) {
+		return resp, res
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	return resp, res
+}
+
+func TestProverNice(t *testing.T) {
+	app := newTestServer(t, "PROVER_NICE", "5").app()
+	resp, res := prove(t, app, `{"formula":"nice","options":{},"timeout":5}`)
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if got := strings.TrimSpace(res.Result["stdout"].(string)); got != "5" {
+		t.Errorf("nice = %q, want 5", got)
+	}
+}
+
+func TestNestedFiles(t *testing.T) {
+	app := newTestServer(t).app()
+	_, res := prove(t, app, `{"formula":"nested","options":{},"timeout":5}`)
+	if got := res.Files["txt"]["a/shallow"]; got != "shallow\n" {
+		t.Errorf("a/shallow = %q, want shallow", got)
+	}
+	// deeper than maxOutputDepth
+	if _, ok := res.Files["txt"]["a/b/c/d/e/deep"]; ok {
+		t.Error("deep file returned")
+	}
+}
+
+// captureLogs returns structured logs written until the end of the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return &buf
+}
+
+func TestFailureLog(t *testing.T) {
+	logs := captureLogs(t)
+	app := newTestServer(t).app()
+	prove(t, app, `{"formula":"fail","options":{},"timeout":5}`)
+	for _, want := range []string{`"msg":"Prover failed"`, `"exit_code":1`, `"output":"failed\n"`, `"formula_hash":"`} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("logs missing %s", want)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	s := newTestServer(t)
+	s.config.RequestTimeout = 100 * time.Millisecond
+	app := s.app()
+	// handler finishing after the deadline
+	app.Get("/slow", func(c *fiber.Ctx) error {
+		time.Sleep(200 * time.Millisecond)
+		c.Set(headerOutcome, "done")
+		return c.SendString("late")
+	})
+	resp := do(t, app, fiber.MethodGet, "/slow", "")
+	if resp.StatusCode != fiber.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", resp.StatusCode)
+	}
+	if v := resp.Header.Get(headerOutcome); v != "" {
+		t.Errorf("%s = %q, want none", headerOutcome, v)
+	}
+}
+
+func TestIncludeRawResult(t *testing.T) {
+	app := newTestServer(t).app()
+	_, res := prove(t, app, `{"formula":"p","options":{},"timeout":5}`)
+	if _, ok := res.Files["yaml"]; ok {
+		t.Error("result.yaml returned without include_raw_result")
+	}
+	_, res = prove(t, app, `{"formula":"p","options":{},"timeout":5,"include_raw_result":true}`)
+	if got := res.Files["yaml"]["result"]; got != "result: provable\nsteps: 3\n" {
+		t.Errorf("result.yaml = %q", got)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	s := newTestServer(t)
+	s.ready.Store(false)
+	resp := do(t, s.app(), fiber.MethodPost, "/", `{"formula":"p","options":{},"timeout":5}`)
+	if resp.StatusCode != fiber.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", resp.StatusCode)
+	}
+	delay, err := strconv.Atoi(resp.Header.Get(fiber.HeaderRetryAfter))
+	if err != nil || delay < retryAfter || delay > 2*retryAfter {
+		t.Errorf("Retry-After = %q, want between %d and %d", resp.Header.Get(fiber.HeaderRetryAfter), retryAfter, 2*retryAfter)
+	}
+	var body struct {
+		Error      string `json:"error"`
+		RetryAfter int    `json:"retry_after"`
+		Backoff    struct {
+			InitialS   int    `json:"initial_s"`
+			Multiplier int    `json:"multiplier"`
+			MaxS       int    `json:"max_s"`
+			Jitter     string `json:"jitter"`
+		} `json:"backoff"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error == "" || body.RetryAfter != delay {
+		t.Errorf("error = %q, retry_after = %d, want Retry-After %d", body.Error, body.RetryAfter, delay)
+	}
+	if body.Backoff.InitialS != retryAfter || body.Backoff.Multiplier != retryMultiplier || body.Backoff.MaxS != retryMaxDelay || body.Backoff.Jitter != "full" {
+		t.Errorf("backoff = %+v", body.Backoff)
+	}
+}
+
+func TestSchemaViolation(t *testing.T) {
+	app := newTestServer(t).app()
+	resp := do(t, app, fiber.MethodPost, "/", `{"formula":"p","options":{},"timeout":"5"}`)
+	var res struct {
+		Error   string              `json:"error"`
+		Details []map[string]string `json:"details"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusBadRequest || res.Error != "schema violation" {
+		t.Fatalf("status = %d, error = %q, want 400 schema violation", resp.StatusCode, res.Error)
+	}
+	if !slices.ContainsFunc(res.Details, func(d map[string]string) bool { return d["path"] == "/timeout" }) {
+		t.Errorf("details = %+v, want /timeout", res.Details)
+	}
+}
+
+func TestCompressMinSize(t *testing.T) {
+	body := `{"formula":"options","options":{"pad":"` + strings.Repeat("x", 1000) + `"},"timeout":5}`
+	for _, tt := range []struct {
+		min  string
+		want string
+	}{
+		{"0", "gzip"},
+		{"100000", ""},
+	} {
+		app := newTestServer(t, "COMPRESS_MIN_SIZE", tt.min).app()
+		resp := do(t, app, fiber.MethodPost, "/", body, fiber.HeaderAcceptEncoding, "gzip")
+		if got := resp.Header.Get(fiber.HeaderContentEncoding); got != tt.want {
+			t.Errorf("COMPRESS_MIN_SIZE=%s: Content-Encoding = %q, want %q", tt.min, got, tt.want)
+		}
+	}
+}
+
+func TestCompressLevelInvalid(t *testing.T) {
+	t.Setenv("COMPRESS_LEVEL", "3")
+	if _, err := loadConfig(); err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestOutcomeHeader(t *testing.T) {
+	app := newTestServer(t).app()
+	for formula, want := range map[string]string{
+		"p":          "done",
+		"slowresult": "timeout",
+		"failresult": "error",
+	} {
+		resp, _ := prove(t, app, `{"formula":"`+formula+`","options":{},"timeout_ms":200}`)
+		if got := resp.Header.Get(headerOutcome); got != want {
+			t.Errorf("%s: %s = %q, want %q", formula, headerOutcome, got, want)
+		}
+	}
+}
+
+func TestProverEnv(t *testing.T) {
+	t.Setenv("STUB_SECRET", "hidden")
+	app := newTestServer(t, "STUB_FOO", "bar", "PROVER_ENV", "PATH,STUB_FOO").app()
+	_, res := prove(t, app, `{"formula":"env","options":{},"timeout":5}`)
+	stdout, _ := res.Result["stdout"].(string)
+	if !strings.Contains(stdout, "STUB_FOO=bar") {
+		t.Errorf("stdout = %q, want STUB_FOO=bar", stdout)
+	}
+	if strings.Contains(stdout, "STUB_SECRET") {
+		t.Error("variable not in PROVER_ENV passed")
+	}
+}
+
+func TestRenderPDF(t *testing.T) {
+	body := `{"formula":"tex","options":{},"timeout":5,"render":"pdf"}`
+	resp, _ := prove(t, newTestServer(t).app(), body)
+	if resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("status = %d, want 400 if disabled", resp.StatusCode)
+	}
+
+	latex, err := filepath.Abs(filepath.Join("bin", "latex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stubLog := filepath.Join(t.TempDir(), "log")
+	app := newTestServer(t, "PDF_RENDERER", latex, "ADMIN_TOKEN", "secret", "PROVER_ENV", "PATH,STUB_LOG", "STUB_LOG", stubLog).app()
+	_, res := prove(t, app, body)
+	if got := res.Files["pdf"]["proof"]; got != base64.StdEncoding.EncodeToString([]byte("%PDF-stub\n")) {
+		t.Errorf("pdf = %q", got)
+	}
+
+	// hardened and without server secrets
+	logs, err := os.ReadFile(stubLog) // #nosec G304
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"latex -no-shell-escape ", "openin_any=p\n", "openout_any=p\n"} {
+		if !strings.Contains(string(logs), want) {
+			t.Errorf("LaTeX log missing %q", want)
+		}
+	}
+	if strings.Contains(string(logs), "ADMIN_TOKEN") {
+		t.Error("LaTeX got server secrets")
+	}
+	if dirs, _ := filepath.Glob("tmp-pdf-*"); len(dirs) > 0 {
+		t.Errorf("PDF directories left: %v", dirs)
+	}
+}
+
+func TestProverVerification(t *testing.T) {
+	t.Setenv("PROVERS", "prover,missing")
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newServer(cfg); err == nil {
+		t.Error("want error for missing prover")
+	}
+
+	s := newTestServer(t, "PROVERS", "prover")
+	s.warmUp(t.Context())
+	if got := s.provers["prover"].Version; got != "stub 1.0" {
+		t.Errorf("version = %q, want stub 1.0", got)
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	app := newTestServer(t).app()
+	resp := do(t, app, fiber.MethodPost, "/", `{"formula":"p","options":{},"timeout":5}`)
+	if body, _ := io.ReadAll(resp.Body); !bytes.Contains(body, []byte(`"warnings":[]`)) {
+		t.Errorf("body = %s, want empty warnings", body)
+	}
+	_, res := prove(t, app, `{"formula":"warnings","options":{},"timeout":5}`)
+	if !slices.Equal(res.Warnings, []string{"w1", "w2"}) {
+		t.Errorf("warnings = %q, want [w1 w2]", res.Warnings)
+	}
+	if _, ok := res.Result["warnings"]; ok {
+		t.Error("warnings left in result")
+	}
+}
+
+func TestAdminWarm(t *testing.T) {
+	calls := filepath.Join(t.TempDir(), "calls.log")
+	app := newTestServer(t, "STUB_LOG", calls, "PROVERS", "prover", "ADMIN_TOKEN", "secret").app()
+	if resp := do(t, app, fiber.MethodPost, "/admin/warm", ""); resp.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("status = %d, want 401 without token", resp.StatusCode)
+	}
+	resp := do(t, app, fiber.MethodPost, "/admin/warm", "", fiber.HeaderAuthorization, "Bearer secret")
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	data, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a real proof through PROVER_ARGS, not a version probe
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], "prover --out /") {
+		t.Errorf("calls = %q, want one proof", lines)
+	}
+	if dirs, _ := filepath.Glob("tmp-warm-*"); len(dirs) > 0 {
+		t.Errorf("temp directories left: %v", dirs)
+	}
+}
+
+func TestEmptyResult(t *testing.T) {
+	resp, res := prove(t, newTestServer(t).app(), `{"formula":"empty","options":{},"timeout":5}`)
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if res.Result["prover"] != "prover" {
+		t.Errorf("result = %v", res.Result)
+	}
+}
+
+func TestResultLimits(t *testing.T) {
+	app := newTestServer(t).app()
+	resp, res := prove(t, app, `{"formula":"alias","options":{},"timeout":5}`)
+	if resp.StatusCode != fiber.StatusInternalServerError || res.Error != "result.yaml must not contain aliases" {
+		t.Errorf("alias: status = %d, error = %q", resp.StatusCode, res.Error)
+	}
+
+	// rejected quickly before parsing
+	start := time.Now()
+	resp, res = prove(t, app, `{"formula":"deep","options":{},"timeout":5}`)
+	if resp.StatusCode != fiber.StatusInternalServerError || res.Error != "result.yaml nested too deeply" {
+		t.Errorf("depth: status = %d, error = %q", resp.StatusCode, res.Error)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("depth check took %v", d)
+	}
+	for _, tt := range []struct {
+		content string
+		want    int
+	}{
+		{"result: provable\nsteps: 3\n", 1},
+		{"a:\n  b:\n    - c\n    - d\nx: 1\n", 4},
+		{"- - [b, {c: d}]\n", 5},
+		{"a: '[[[' # [[[\nb: \"[\\\"\"\n", 1},
+		{"a: [\n  [\n    [b]]]\n", 4},
+	} {
+		if got := yamlDepth([]byte(tt.content)); got != tt.want {
+			t.Errorf("yamlDepth(%q) = %d, want %d", tt.content, got, tt.want)
+		}
+	}
+
+	app = newTestServer(t, "RESULT_MAX_SIZE", "10").app()
+	resp, res = prove(t, app, `{"formula":"p","options":{},"timeout":5}`)
+	if resp.StatusCode != fiber.StatusInternalServerError || res.Error != "result.yaml too large" {
+		t.Errorf("size: status = %d, error = %q", resp.StatusCode, res.Error)
+	}
+}
+
+func TestResultProver(t *testing.T) {
+	app := newTestServer(t).app()
+	for trace, want := range map[string]string{"false": "prover", "true": "prover-trace"} {
+		_, res := prove(t, app, `{"formula":"p","options":{},"timeout":5,"trace":`+trace+`}`)
+		if res.Result["prover"] != want {
+			t.Errorf("trace=%s: prover = %v, want %s", trace, res.Result["prover"], want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	// test requests come from 0.0.0.0
+	header := "6.6.6.6, 1.2.3.4, 10.0.0.1"
+	for _, tt := range []struct {
+		proxies string
+		want    string
+	}{
+		{"", "0.0.0.0"},
+		{"10.0.0.0/8", "0.0.0.0"},
+		{"0.0.0.0,10.0.0.0/8", "1.2.3.4"},
+		{"0.0.0.0,10.0.0.0/8,1.2.3.4", "6.6.6.6"},
+	} {
+		s := newTestServer(t, "TRUSTED_PROXIES", tt.proxies)
+		var accessLog bytes.Buffer
+		s.accessLog = &accessLog
+		app := s.app()
+		app.Get("/ip", func(c *fiber.Ctx) error {
+			return c.SendString(s.clientIP(c))
+		})
+		resp := do(t, app, fiber.MethodGet, "/ip", "", fiber.HeaderXForwardedFor, header)
+		if got, _ := io.ReadAll(resp.Body); string(got) != tt.want {
+			t.Errorf("TRUSTED_PROXIES=%s: client IP = %s, want %s", tt.proxies, got, tt.want)
+		}
+		if !strings.Contains(accessLog.String(), "| "+tt.want+" |") {
+			t.Errorf("TRUSTED_PROXIES=%s: access log = %q, want IP %s", tt.proxies, accessLog.String(), tt.want)
+		}
+	}
+
+	t.Setenv("TRUSTED_PROXIES", "proxy")
+	if _, err := loadConfig(); err == nil {
+		t.Error("want error for invalid TRUSTED_PROXIES")
+	}
+}
+
+func TestStreamLogs(t *testing.T) {
+	logs := captureLogs(t)
+	app := newTestServer(t, "STREAM_PROVER_LOGS", "true").app()
+	prove(t, app, `{"formula":"lines","options":{},"timeout":5}`)
+	if got := strings.Count(logs.String(), `"msg":"Prover output"`); got != 10 {
+		t.Errorf("logged %d lines, want 10", got)
+	}
+}
+
+func TestTraceFallback(t *testing.T) {
+	body := `{"formula":"tracefail","options":{},"timeout":5,"trace":true}`
+	// failed trace prover wrote no result.yaml
+	if resp, _ := prove(t, newTestServer(t).app(), body); resp.StatusCode != fiber.StatusInternalServerError {
+		t.Errorf("status = %d, want 500 without fallback", resp.StatusCode)
+	}
+
+	_, res := prove(t, newTestServer(t, "TRACE_FALLBACK", "true").app(), body)
+	if res.Result["prover"] != "prover" || res.Result["trace_failed"] != true || res.Result["trace_stdout"] != "trace failed\n" {
+		t.Errorf("result = %v, want fallback to prover", res.Result)
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	_, res := prove(t, newTestServer(t).app(), `{"formula":"same","options":{},"timeout":5,"dedupe":true}`)
+	key := res.Files["txt"]["a"]
+	if key == "" || res.Files["txt"]["b"] != key || res.Blobs[key] != "same\n" {
+		t.Errorf("files = %v, blobs = %v", res.Files, res.Blobs)
+	}
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	// fits one of a.txt, b.txt and proof.txt of 5, 5 and 6 bytes
+	_, res := prove(t, newTestServer(t, "MAX_RESPONSE_SIZE", "8").app(), `{"formula":"same","options":{},"timeout":5}`)
+	if res.Result["response_truncated"] != true || len(res.Files["txt"]) != 1 {
+		t.Errorf("files = %v, result = %v", res.Files, res.Result)
+	}
+}
+
+// openAPISchema is the OpenAPI 3.1 schema of 2022-10-07 from spec.openapis.org.
+//
+//go:embed testdata/openapi-3.1.schema.json
+var openAPISchema []byte
+
+func TestOpenAPI(t *testing.T) {
+	s := newTestServer(t)
+	resp := do(t, s.app(), fiber.MethodGet, "/openapi.json", "")
+	var doc struct {
+		Components struct {
+			Schemas map[string]any `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	var schema any
+	if err := json.Unmarshal(requestSchema, &schema); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(doc.Components.Schemas["Request"], schema) {
+		t.Error("Request schema differs from request.schema.json")
+	}
+
+	// validate against the OpenAPI 3.1 schema, and component schemas against their dialect
+	built, err := jsonschema.UnmarshalJSON(bytes.NewReader(s.openAPI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oas, err := jsonschema.UnmarshalJSON(bytes.NewReader(openAPISchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := jsonschema.NewCompiler()
+	if err := c.AddResource("https://spec.openapis.org/oas/3.1/schema/2022-10-07", oas); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddResource("file:///openapi.json", built); err != nil {
+		t.Fatal(err)
+	}
+	sch, err := c.Compile("https://spec.openapis.org/oas/3.1/schema/2022-10-07")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sch.Validate(built); err != nil {
+		t.Errorf("invalid OpenAPI document: %v", err)
+	}
+	for name := range doc.Components.Schemas {
+		if _, err := c.Compile("file:///openapi.json#/components/schemas/" + name); err != nil {
+			t.Errorf("invalid schema %s: %v", name, err)
+		}
+	}
+}
+
+func TestSymlinkSkipped(t *testing.T) {
+	_, res := prove(t, newTestServer(t).app(), `{"formula":"symlink","options":{},"timeout":5}`)
+	if res.Files["txt"]["ok"] != "ok\n" {
+		t.Errorf("files = %v, want ok.txt", res.Files)
+	}
+	// points outside the temp directory
+	if _, ok := res.Files["txt"]["leak"]; ok {
+		t.Error("symlink followed")
+	}
+}
+
+func TestProverArgs(t *testing.T) {
+	app := newTestServer(t, "PROVER_ARGS", `["--formula","{formula}","--out","{out}"]`).app()
+	_, res := prove(t, app, `{"formula":"args","options":{},"timeout":5}`)
+	stdout, _ := res.Result["stdout"].(string)
+	if !regexp.MustCompile(`^--formula /\S+/tmp-\S+/formula.txt --out /\S+/tmp-\S+\n$`).MatchString(stdout) {
+		t.Errorf("args = %q", stdout)
+	}
+
+	t.Setenv("PROVER_ARGS", `["--out","{tmp}"]`)
+	if _, err := loadConfig(); err == nil {
+		t.Error("want error for unknown placeholder")
+	}
+}
+
+func TestMsgpack(t *testing.T) {
+	resp := do(t, newTestServer(t).app(), fiber.MethodPost, "/", `{"formula":"p","options":{},"timeout":5}`, fiber.HeaderAccept, mimeMsgpack)
+	if got := resp.Header.Get(fiber.HeaderContentType); got != mimeMsgpack {
+		t.Fatalf("Content-Type = %q, want %s", got, mimeMsgpack)
+	}
+	var res map[string]any
+	if err := msgpack.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res["result"].(map[string]any)["result"] != "provable" {
+		t.Errorf("body = %v", res)
+	}
+}
+
+func TestCleanupFailures(t *testing.T) {
+	s := newTestServer(t, "CLEANUP_FAILURE_THRESHOLD", "2", "ADMIN_TOKEN", "secret")
+	app := s.app()
+	for range 2 {
+		if resp := do(t, app, fiber.MethodGet, "/readyz", ""); resp.StatusCode != fiber.StatusOK {
+			t.Errorf("readyz = %d, want 200 under threshold", resp.StatusCode)
+		}
+		s.recordCleanupFailure()
+	}
+	if resp := do(t, app, fiber.MethodGet, "/readyz", ""); resp.StatusCode != fiber.StatusServiceUnavailable {
+		t.Errorf("readyz = %d, want 503 at threshold", resp.StatusCode)
+	}
+	resp := do(t, app, fiber.MethodGet, "/admin/cleanup", "", fiber.HeaderAuthorization, "Bearer secret")
+	if body, _ := io.ReadAll(resp.Body); string(body) != `{"failures_total":2,"recent_failures":2}` {
+		t.Errorf("stats = %s", body)
+	}
+
+	// disabled if 0
+	s = newTestServer(t, "CLEANUP_FAILURE_THRESHOLD", "0")
+	s.recordCleanupFailure()
+	if resp := do(t, s.app(), fiber.MethodGet, "/readyz", ""); resp.StatusCode != fiber.StatusOK {
+		t.Errorf("readyz = %d, want 200 if disabled", resp.StatusCode)
+	}
+}
+
+func TestRetainOnError(t *testing.T) {
+	s := newTestServer(t, "RETAIN_ON_ERROR", "true", "RETAIN_TTL", "0", "INCLUDE_RUN_ID", "true")
+	app := s.app()
+	_, res := prove(t, app, `{"formula":"failresult","options":{},"timeout":5}`)
+	s.bg.Wait()
+	dir, _ := res.Result["run_id"].(string)
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatalf("failed run not retained: %v", err)
+	}
+	_, res = prove(t, app, `{"formula":"p","options":{},"timeout":5}`)
+	s.bg.Wait()
+	if _, err := os.Stat(res.Result["run_id"].(string)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("successful run retained: %v", err)
+	}
+
+	// kept for the request timeout even with TTL 0, since new directories may not be registered yet
+	if removed, _ := s.sweep(); removed != 0 {
+		t.Errorf("swept %d younger than the request timeout, want 0", removed)
+	}
+	old := time.Now().Add(-s.config.RequestTimeout)
+	if err := os.Chtimes(dir, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if removed, _ := s.sweep(); removed != 1 {
+		t.Errorf("swept %d, want 1", removed)
+	}
+	if _, err := os.Stat(dir); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("retained directory not swept: %v", err)
+	}
+}
+
+func TestStoppedWithoutResult(t *testing.T) {
+	app := newTestServer(t).app()
+	resp, res := prove(t, app, `{"formula":"kill","options":{},"timeout":5}`)
+	if resp.StatusCode != fiber.StatusOK || res.Result["killed"] != "signal: killed" {
+		t.Errorf("killed: status = %d, result = %v", resp.StatusCode, res.Result)
+	}
+	resp, res = prove(t, app, `{"formula":"sleep","options":{},"timeout_ms":100}`)
+	if resp.StatusCode != fiber.StatusOK || res.Result["timeout"] != true {
+		t.Errorf("timeout: status = %d, result = %v", resp.StatusCode, res.Result)
+	}
+}
+
+func TestPreprocess(t *testing.T) {
+	app := newTestServer(t, "PREPROCESS", "trim,collapse_spaces").app()
+	_, res := prove(t, app, `{"formula":"  options ","options":{},"timeout":5}`)
+	if !reflect.DeepEqual(res.Result["preprocess"], []any{"trim", "collapse_spaces"}) || res.Result["stdout"] != "{}" {
+		t.Errorf("result = %v, want trimmed formula", res.Result)
+	}
+	resp, res := prove(t, app, `{"formula":"  ","options":{},"timeout":5}`)
+	if resp.StatusCode != fiber.StatusBadRequest || res.Error != "formula is empty after preprocessing" {
+		t.Errorf("status = %d, error = %q", resp.StatusCode, res.Error)
+	}
+
+	t.Setenv("PREPROCESS", "upper")
+	if _, err := loadConfig(); err == nil {
+		t.Error("want error for unknown transform")
+	}
+}
+
+func TestSelfCheck(t *testing.T) {
+	logs := captureLogs(t)
+	s := newTestServer(t, "ADMIN_TOKEN", "secret")
+	if err := s.selfCheck(); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"msg":"Self-check passed"`, `"admin_token":"REDACTED"`, `"free_disk":`} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("logs missing %s", want)
+		}
+	}
+	if strings.Contains(logs.String(), "secret") {
+		t.Error("admin token logged")
+	}
+}
+
+func TestSigning(t *testing.T) {
+	s := newTestServer(t, "RESPONSE_SIGNING_KEY", "key", "COMPRESS_LEVEL", "-1")
+	s.config.RequestTimeout = 100 * time.Millisecond
+	app := s.app()
+	app.Get("/slow", func(c *fiber.Ctx) error {
+		time.Sleep(200 * time.Millisecond)
+		return c.SendString("late")
+	})
+	for _, tt := range []struct {
+		method, target, body string
+		status               int
+	}{
+		{fiber.MethodPost, "/", `{"formula":"p","options":{},"timeout":5}`, fiber.StatusOK},
+		{fiber.MethodGet, "/slow", "", fiber.StatusServiceUnavailable},
+		{fiber.MethodGet, "/missing", "", fiber.StatusNotFound},
+	} {
+		resp := do(t, app, tt.method, tt.target, tt.body)
+		body, _ := io.ReadAll(resp.Body)
+		mac := hmac.New(sha256.New, []byte("key"))
+		mac.Write(body)
+		if resp.StatusCode != tt.status || resp.Header.Get(headerSignature) != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("%s: status = %d, signature = %q, want %d signed", tt.target, resp.StatusCode, resp.Header.Get(headerSignature), tt.status)
+		}
+	}
+}
+
+func TestFileTransforms(t *testing.T) {
+	app := newTestServer(t, "FILE_TRANSFORMS", "json=json_pretty,txt=trim").app()
+	_, res := prove(t, app, `{"formula":"json","options":{},"timeout":5}`)
+	if res.Files["json"]["proof"] != "{\n  \"a\": 1\n}\n" || res.Files["txt"]["proof"] != "proof" {
+		t.Errorf("files = %q", res.Files)
+	}
+
+	t.Setenv("FILE_TRANSFORMS", "json=yaml")
+	if _, err := loadConfig(); err == nil {
+		t.Error("want error for unknown transform")
+	}
+}
+
+func TestIncludeCommand(t *testing.T) {
+	app := newTestServer(t, "INCLUDE_COMMAND", "true", "PROVER_DEFAULT_OPTIONS", `{"prover":{"depth":3,"mode":"fast"}}`).app()
+	_, res := prove(t, app, `{"formula":"p","options":{"depth":5},"timeout":5}`)
+	// placeholders hide server paths
+	if !reflect.DeepEqual(res.Result["command"], []any{"prover", "--out", "{out}"}) {
+		t.Errorf("command = %v", res.Result["command"])
+	}
+	if want := map[string]any{"depth": float64(5), "mode": "fast"}; !reflect.DeepEqual(res.Result["command_options"], want) {
+		t.Errorf("command_options = %v, want %v", res.Result["command_options"], want)
+	}
+}
+
+func TestTempDirVanished(t *testing.T) {
+	resp, res := prove(t, newTestServer(t).app(), `{"formula":"vanish","options":{},"timeout":5}`)
+	if resp.StatusCode != fiber.StatusInternalServerError || res.Error != "temp directory was removed during the request" {
+		t.Errorf("status = %d, error = %q", resp.StatusCode, res.Error)
+	}
+}
+
+func TestTimings(t *testing.T) {
+	_, res := prove(t, newTestServer(t).app(), `{"formula":"warnings","options":{},"timeout":5}`)
+	if !reflect.DeepEqual(res.Timings, map[string]float64{"parse": 1, "search": 2.5}) {
+		t.Errorf("timings = %v", res.Timings)
+	}
+	if _, ok := res.Result["timings"]; ok {
+		t.Error("timings left in result")
+	}
+}
+
+func TestFieldsProjection(t *testing.T) {
+	resp := do(t, newTestServer(t).app(), fiber.MethodPost, "/?fields=result.result,warnings,result.missing", `{"formula":"p","options":{},"timeout":5}`)
+	if body, _ := io.ReadAll(resp.Body); string(body) != `{"result":{"result":"provable"},"warnings":[]}` {
+		t.Errorf("body = %s", body)
+	}
+}
+
+func TestStrictJSON(t *testing.T) {
+	app := newTestServer(t, "STRICT_JSON", "true").app()
+	for body, want := range map[string]string{
+		`{"formula":"p","formula":"q","options":{},"timeout":5}`:           "duplicate key: /formula",
+		`{"formula":"p","options":{"a":1,"a":2},"timeout":5}`:              "duplicate key: /options/a",
+		`{"formula":"p","options":{},"timeout":5,"unknown":true}`:          `invalid JSON: json: unknown field "unknown"`,
+		`{"formula":"p","options":{"nested":[{"b":1,"b":1}]},"timeout":5}`: "duplicate key: /options/nested/0/b",
+	} {
+		resp, res := prove(t, app, body)
+		if resp.StatusCode != fiber.StatusBadRequest || res.Error != want {
+			t.Errorf("%s: status = %d, error = %q, want %q", body, resp.StatusCode, res.Error, want)
+		}
+	}
+	if resp, _ := prove(t, newTestServer(t, "STRICT_JSON", "").app(), `{"formula":"p","options":{},"timeout":5,"unknown":true}`); resp.StatusCode != fiber.StatusOK {
+		t.Errorf("status = %d, want 200 unless strict", resp.StatusCode)
+	}
+}
+
+func TestCleanupAfterShutdown(t *testing.T) {
+	s := newTestServer(t, "INCLUDE_RUN_ID", "true")
+	app := s.app()
+	if !s.stopBackground(time.Second) {
+		t.Fatal("background work not stopped")
+	}
+	// requests finishing after shutdown remove temp directories synchronously
+	_, res := prove(t, app, `{"formula":"p","options":{},"timeout":5}`)
+	if _, err := os.Stat(res.Result["run_id"].(string)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("temp directory left: %v", err)
+	}
+}
+
+func TestStopBackground(t *testing.T) {
+	s := newTestServer(t, "RETAIN_ON_ERROR", "true", "RETAIN_TTL", "0")
+	dir, err := os.MkdirTemp(".", "tmp-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(dir, old, old); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	s.goBackground(func() { s.sweepLoop(ctx, 10*time.Millisecond) })
+	// sweeps while running
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("not swept")
+		}
+	}
+	cancel()
+	if !s.stopBackground(time.Second) {
+		t.Error("sweep loop not stopped after cancel")
+	}
+
+	// report workers outliving the timeout
+	s = newTestServer(t)
+	release := make(chan struct{})
+	s.goBackground(func() { <-release })
+	if s.stopBackground(50 * time.Millisecond) {
+		t.Error("stopped with a blocked worker")
+	}
+	close(release)
+}
+
+func TestTimeoutMs(t *testing.T) {
+	start := time.Now()
+	_, res := prove(t, newTestServer(t).app(), `{"formula":"slowresult","options":{},"timeout_ms":100}`)
+	if res.Result["timeout"] != true {
+		t.Errorf("result = %v, want timeout", res.Result)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("took %s, want sub-second timeout", d)
+	}
+}
+
+func TestEncodedFormula(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte("options")); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	app := newTestServer(t).app()
+	_, res := prove(t, app, `{"formula":"`+encoded+`","encoding":"gzip+base64","options":{},"timeout":5}`)
+	if res.Result["stdout"] != "{}" {
+		t.Errorf("result = %v, want decoded formula", res.Result)
+	}
+	resp, res := prove(t, app, `{"formula":"p","encoding":"gzip+base64","options":{},"timeout":5}`)
+	if resp.StatusCode != fiber.StatusBadRequest || !strings.HasPrefix(res.Error, "invalid encoded formula") {
+		t.Errorf("status = %d, error = %q", resp.StatusCode, res.Error)
+	}
+}
+
+func TestAdminConfig(t *testing.T) {
+	app := newTestServer(t, "ADMIN_TOKEN", "secret", "RESPONSE_SIGNING_KEY", "key").app()
+	if resp := do(t, app, fiber.MethodGet, "/admin/config", "", fiber.HeaderAuthorization, "Bearer wrong"); resp.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("status = %d, want 401 with wrong token", resp.StatusCode)
+	}
+	resp := do(t, app, fiber.MethodGet, "/admin/config", "", fiber.HeaderAuthorization, "Bearer secret")
+	var cfg Config
+	if err := json.NewDecoder(resp.Body).Decode(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.AdminToken != "REDACTED" || cfg.SigningKey != "REDACTED" {
+		t.Errorf("secrets not redacted: %+v", cfg)
+	}
+}
+
+func TestMaxStdoutLines(t *testing.T) {
+	_, res := prove(t, newTestServer(t, "MAX_STDOUT_LINES", "3").app(), `{"formula":"lines","options":{},"timeout":5}`)
+	if res.Result["stdout"] != "1\n2\n3\n[output truncated after 3 lines]\n" || res.Result["stdout_truncated"] != true {
+		t.Errorf("result = %v", res.Result)
+	}
+
+	// lines split across writes
+	var buf bytes.Buffer
+	cancelled := false
+	l := &lineLimiter{w: &buf, max: 2, onLimit: func() { cancelled = true }}
+	for _, p := range []string{"a", "b\nc", "d\ne\n", "f\n"} {
+		if n, err := l.Write([]byte(p)); err != nil || n != len(p) {
+			t.Fatalf("Write(%q) = %d, %v", p, n, err)
+		}
+	}
+	if buf.String() != "ab\ncd\n[output truncated after 2 lines]\n" || !l.truncated || !cancelled {
+		t.Errorf("output = %q, truncated = %v, cancelled = %v", buf.String(), l.truncated, cancelled)
+	}
+}
+
+func TestIncludeRunID(t *testing.T) {
+	_, res := prove(t, newTestServer(t, "INCLUDE_RUN_ID", "true").app(), `{"formula":"p","options":{},"timeout":5}`)
+	if id, _ := res.Result["run_id"].(string); !strings.HasPrefix(id, "tmp-") {
+		t.Errorf("run_id = %q", id)
+	}
+	_, res = prove(t, newTestServer(t, "INCLUDE_RUN_ID", "").app(), `{"formula":"p","options":{},"timeout":5}`)
+	if _, ok := res.Result["run_id"]; ok {
+		t.Error("run_id returned unless enabled")
+	}
+}
+
+func TestIncludeUsage(t *testing.T) {
+	_, res := prove(t, newTestServer(t, "INCLUDE_USAGE", "true").app(), `{"formula":"p","options":{},"timeout":5}`)
+	usage, _ := res.Result["usage"].(map[string]any)
+	for _, key := range []string{"user_time_ms", "system_time_ms", "max_rss_bytes"} {
+		if _, ok := usage[key]; !ok {
+			t.Errorf("usage missing %s: %v", key, usage)
+		}
+	}
+}
+
+func TestMaxOutputBytes(t *testing.T) {
+	app := newTestServer(t, "MAX_OUTPUT_BYTES", "50000").app()
+	for _, formula := range []string{"flood", "bigfile"} {
+		start := time.Now()
+		resp, res := prove(t, app, `{"formula":"`+formula+`","options":{},"timeout":5}`)
+		if resp.StatusCode != fiber.StatusOK || res.Result["output_limit_exceeded"] != true {
+			t.Errorf("%s: status = %d, result = %v", formula, resp.StatusCode, res.Result)
+		}
+		if stdout, _ := res.Result["stdout"].(string); len(stdout) > 50000 {
+			t.Errorf("%s: stdout of %d bytes", formula, len(stdout))
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("%s: took %s, want stopped at budget", formula, d)
+		}
+	}
+
+	var buf bytes.Buffer
+	stopped := false
+	l := &byteLimiter{w: &buf, max: 5, onLimit: func() { stopped = true }}
+	for _, p := range []string{"abc", "def", "ghi"} {
+		if n, err := l.Write([]byte(p)); err != nil || n != len(p) {
+			t.Fatalf("Write(%q) = %d, %v", p, n, err)
+		}
+	}
+	if buf.String() != "abcde" || !l.exceeded || !stopped {
+		t.Errorf("output = %q, exceeded = %v, stopped = %v", buf.String(), l.exceeded, stopped)
+	}
+}
+
+// tarEntry is an entry of a test archive.
+type tarEntry struct {
+	name, content string
+	typeflag      byte
+}
+
+// archive returns a tar archive of the entries, linking symlinks to /etc/passwd.
+func archive(t *testing.T, entries ...tarEntry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		h := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: 0o644, Size: int64(len(e.content))}
+		if e.typeflag == tar.TypeSymlink {
+			h.Linkname, h.Size = "/etc/passwd", 0
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestArchive(t *testing.T) {
+	app := newTestServer(t).app()
+	body := archive(t, tarEntry{"./formula.txt", "options", tar.TypeReg}, tarEntry{"options.json", `{"a":1}`, tar.TypeReg})
+	resp := do(t, app, fiber.MethodPost, "/archive?timeout=5", body)
+	var res testResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Result["stdout"] != "{\n  \"a\": 1\n}" {
+		t.Errorf("result = %v", res.Result)
+	}
+
+	for _, e := range []tarEntry{
+		{"../formula.txt", "p", tar.TypeReg},
+		{"/options.json", "{}", tar.TypeReg},
+		{"formula.txt", "", tar.TypeSymlink},
+		{"result.yaml", "result: provable", tar.TypeReg},
+	} {
+		resp := do(t, app, fiber.MethodPost, "/archive?timeout=5", archive(t, e))
+		if resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", e.name, resp.StatusCode)
+		}
+	}
+}
+
+func TestOutputFormats(t *testing.T) {
+	app := newTestServer(t, "OUTPUT_FORMATS", "svg=--emit=svg,dot=--emit=dot").app()
+	_, res := prove(t, app, `{"formula":"p","options":{},"timeout":5,"output_formats":["svg"]}`)
+	if res.Files["svg"]["proof"] != "proof\n" || res.Files["dot"] != nil {
+		t.Errorf("files = %v, want svg only", res.Files)
+	}
+	resp, res := prove(t, app, `{"formula":"p","options":{},"timeout":5,"output_formats":["png"]}`)
+	if resp.StatusCode != fiber.StatusBadRequest || res.Error != "unsupported output format: png" {
+		t.Errorf("status = %d, error = %q", resp.StatusCode, res.Error)
+	}
+}
+
+func TestProverMaxFiles(t *testing.T) {
+	_, res := prove(t, newTestServer(t, "PROVER_MAX_FILES", "64").app(), `{"formula":"files","options":{},"timeout":5}`)
+	if got := strings.TrimSpace(res.Result["stdout"].(string)); got != "64" {
+		t.Errorf("open file limit = %q, want 64", got)
+	}
+}
+
+func TestExplanationTemplate(t *testing.T) {
+	app := newTestServer(t, "EXPLANATION_TEMPLATE", "{{.result}} in {{.steps}} steps").app()
+	_, res := prove(t, app, `{"formula":"p","options":{},"timeout":5}`)
+	if res.Result["explanation"] != "provable in 3 steps" {
+		t.Errorf("explanation = %v", res.Result["explanation"])
+	}
+
+	t.Setenv("EXPLANATION_TEMPLATE", "{{.result")
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newServer(cfg); err == nil {
+		t.Error("want error for invalid template")
+	}
+}
+
+func TestResultEncoding(t *testing.T) {
+	app := newTestServer(t).app()
+	for formula, want := range map[string]string{"bom": "provable", "badutf": "a�b"} {
+		resp, res := prove(t, app, `{"formula":"`+formula+`","options":{},"timeout":5}`)
+		if resp.StatusCode != fiber.StatusOK || res.Result["result"] != want {
+			t.Errorf("%s: status = %d, result = %q, want %q", formula, resp.StatusCode, res.Result["result"], want)
+		}
+	}
+}
+
+func TestOutcomeStatus(t *testing.T) {
+	app := newTestServer(t, "UNPROVABLE_RESULTS", "unprovable").app()
+	for _, tt := range []struct {
+		formula, prefer string
+		status          int
+		outcome         string
+	}{
+		{"unprovable", "outcome-status", fiber.StatusUnprocessableEntity, "unprovable"},
+		{"unprovable", "", fiber.StatusOK, "unprovable"},
+		{"p", "outcome-status", fiber.StatusOK, "done"},
+	} {
+		resp, res := prove(t, app, `{"formula":"`+tt.formula+`","options":{},"timeout":5}`, "Prefer", tt.prefer)
+		if resp.StatusCode != tt.status || resp.Header.Get(headerOutcome) != tt.outcome || res.Result["result"] == nil {
+			t.Errorf("%s with Prefer %q: status = %d, outcome = %q, want %d %s", tt.formula, tt.prefer, resp.StatusCode, resp.Header.Get(headerOutcome), tt.status, tt.outcome)
+		}
+	}
+}
+
+func TestRequestIDInTempDir(t *testing.T) {
+	app := newTestServer(t, "INCLUDE_RUN_ID", "true").app()
+	resp, res := prove(t, app, `{"formula":"p","options":{},"timeout":5}`, fiber.HeaderXRequestID, "../abc/"+strings.Repeat("x", 100))
+	if resp.Header.Get(fiber.HeaderXRequestID) == "" {
+		t.Error("missing request ID")
+	}
+	// sanitized and truncated
+	if id, _ := res.Result["run_id"].(string); !strings.HasPrefix(id, "tmp-abc"+strings.Repeat("x", maxRequestIDName-3)+"-") {
+		t.Errorf("run_id = %q", id)
+	}
+}
+
+func TestMaxOptionsDepth(t *testing.T) {
+	app := newTestServer(t, "MAX_OPTIONS_DEPTH", "2").app()
+	if resp, _ := prove(t, app, `{"formula":"p","options":{"a":[1]},"timeout":5}`); resp.StatusCode != fiber.StatusOK {
+		t.Errorf("status = %d, want 200 at max depth", resp.StatusCode)
+	}
+	resp, res := prove(t, app, `{"formula":"p","options":{"a":{"b":[1]}},"timeout":5}`)
+	if resp.StatusCode != fiber.StatusBadRequest || res.Error != "options nested deeper than 2" {
+		t.Errorf("status = %d, error = %q", resp.StatusCode, res.Error)
+	}
+}
+
+func TestAdminCleanup(t *testing.T) {
+	s := newTestServer(t, "ADMIN_TOKEN", "secret")
+	old := time.Now().Add(-48 * time.Hour)
+	for _, dir := range []string{"tmp-stale", "tmp-running"} {
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "proof.txt"), []byte("proof"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(dir, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.active.Store("tmp-running", struct{}{})
+	t.Cleanup(func() { _ = os.RemoveAll("tmp-running") })
+
+	resp := do(t, s.app(), fiber.MethodPost, "/admin/cleanup", "", fiber.HeaderAuthorization, "Bearer secret")
+	if body, _ := io.ReadAll(resp.Body); string(body) != `{"reclaimed_bytes":5,"removed":1}` {
+		t.Errorf("body = %s", body)
+	}
+	if _, err := os.Stat("tmp-running"); err != nil {
+		t.Errorf("running directory swept: %v", err)
+	}
+}
+
+func TestRecentRuns(t *testing.T) {
+	app := newTestServer(t, "RECENT_RUNS", "2", "ADMIN_TOKEN", "secret").app()
+	for _, formula := range []string{"p", "lines", "failresult"} {
+		prove(t, app, `{"formula":"`+formula+`","options":{},"timeout":5}`)
+	}
+	resp := do(t, app, fiber.MethodGet, "/admin/runs", "", fiber.HeaderAuthorization, "Bearer secret")
+	var runs []runRecord
+	if err := json.NewDecoder(resp.Body).Decode(&runs); err != nil {
+		t.Fatal(err)
+	}
+	// newest first
+	if len(runs) != 2 || runs[0].ExitCode != 1 || !strings.HasPrefix(runs[1].Output, "1\n2\n") {
+		t.Errorf("runs = %+v", runs)
+	}
+}
+
+func TestAbsoluteTempPath(t *testing.T) {
+	_, res := prove(t, newTestServer(t).app(), `{"formula":"args","options":{},"timeout":5}`)
+	stdout, _ := res.Result["stdout"].(string)
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir, ok := strings.CutPrefix(strings.TrimSpace(stdout), "--out "); !ok || filepath.Dir(dir) != cwd {
+		t.Errorf("args = %q, want absolute temp directory in %s", stdout, cwd)
+	}
+}
+
+func TestOverhead(t *testing.T) {
+	_, res := prove(t, newTestServer(t).app(), `{"formula":"nice","options":{},"timeout":5}`)
+	// excludes the prover sleeping 500ms
+	if ms, ok := res.Result["overhead_ms"].(float64); !ok || ms < 0 || ms >= 500 {
+		t.Errorf("overhead_ms = %v", res.Result["overhead_ms"])
+	}
+}
+
+func TestProverDefaultOptions(t *testing.T) {
+	app := newTestServer(t, "PROVER_DEFAULT_OPTIONS", `{"prover":{"a":1,"n":{"x":1,"y":2}},"prover-trace":{"t":true}}`).app()
+	for _, tt := range []struct {
+		options, want string
+	}{
+		// request values win, nested objects are merged
+		{`{"n":{"y":3},"b":2}`, `{"a":1,"b":2,"n":{"x":1,"y":3}}`},
+		{`{"n":5}`, `{"a":1,"n":5}`},
+		// defaults are not changed by earlier requests
+		{`{}`, `{"a":1,"n":{"x":1,"y":2}}`},
+	} {
+		_, res := prove(t, app, `{"formula":"options","options":`+tt.options+`,"timeout":5}`)
+		var got, want any
+		if err := json.Unmarshal([]byte(res.Result["stdout"].(string)), &got); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("options %s: got %v, want %v", tt.options, got, want)
+		}
+	}
+
+	// fallback prover gets its own defaults
+	app = newTestServer(t,
+		"PROVER_DEFAULT_OPTIONS", `{"prover":{"plain":1},"prover-trace":{"trace_only":1}}`,
+		"TRACE_FALLBACK", "true", "INCLUDE_COMMAND", "true",
+	).app()
+	_, res := prove(t, app, `{"formula":"traceoptions","options":{"b":2},"timeout":5,"trace":true}`)
+	want := map[string]any{"plain": float64(1), "b": float64(2)}
+	var got map[string]any
+	if err := json.Unmarshal([]byte(res.Result["stdout"].(string)), &got); err != nil {
+		t.Fatal(err)
+	}
+	if res.Result["prover"] != "prover" || !reflect.DeepEqual(got, want) || !reflect.DeepEqual(res.Result["command_options"], want) {
+		t.Errorf("fallback: prover = %v, options = %v, command_options = %v, want %v", res.Result["prover"], got, res.Result["command_options"], want)
+	}
+}
+
+func TestAutoDetect(t *testing.T) {
+	app := newTestServer(t, "PROVER_RULES", `[{"pattern":"^opt","prover":"prover-trace"}]`).app()
+	for _, tt := range []struct {
+		formula, autoDetect, want string
+	}{
+		{"options", "true", "prover-trace"},
+		{"options", "false", "prover"},
+		{"p", "true", "prover"},
+	} {
+		_, res := prove(t, app, `{"formula":"`+tt.formula+`","options":{},"timeout":5,"auto_detect":`+tt.autoDetect+`}`)
+		if res.Result["prover"] != tt.want {
+			t.Errorf("%s with auto_detect %s: prover = %v, want %s", tt.formula, tt.autoDetect, res.Result["prover"], tt.want)
+		}
+	}
+
+	t.Setenv("PROVER_RULES", `[{"pattern":"^p","prover":"other"}]`)
+	if _, err := loadConfig(); err == nil {
+		t.Error("want error for unknown prover")
+	}
+}
+
+func TestBackgroundCleanup(t *testing.T) {
+	s := newTestServer(t, "INCLUDE_RUN_ID", "true")
+	// block removal until released
+	release := make(chan struct{})
+	s.removeAll = func(path string) error {
+		<-release
+		return os.RemoveAll(path)
+	}
+	_, res := prove(t, s.app(), `{"formula":"p","options":{},"timeout":5}`)
+	// responded before removal, still registered so the sweep skips it
+	dir := res.Result["run_id"].(string)
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("temp directory removed before responding: %v", err)
+	}
+	if _, ok := s.active.Load(dir); !ok {
+		t.Error("temp directory unregistered before removal")
+	}
+	close(release)
+	s.bg.Wait()
+	if _, err := os.Stat(dir); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("temp directory left: %v", err)
+	}
+	if _, ok := s.active.Load(dir); ok {
+		t.Error("temp directory still registered")
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	for _, tt := range []struct {
+		env  []string
+		want string
+	}{
+		{[]string{"PROVERS", "prover"}, "archive,dedupe,fields,gzip_formula,include_raw_result,msgpack,timeout_ms"},
+		{
+			[]string{"PROVERS", "prover,prover-trace", "UNPROVABLE_RESULTS", "unprovable", "PREPROCESS", "trim", "MAX_COMPLEXITY", "5", "ADMIN_TOKEN", "secret"},
+			"admin,archive,dedupe,fields,gzip_formula,include_raw_result,max_complexity,msgpack,outcome_status,preprocess,timeout_ms,trace",
+		},
+	} {
+		resp := do(t, newTestServer(t, tt.env...).app(), fiber.MethodGet, "/livez", "")
+		if got := resp.Header.Get(headerCapabilities); got != "api=1.0.0; features="+tt.want {
+			t.Errorf("%v: %s = %q", tt.env, headerCapabilities, got)
+		}
+	}
+}
+
+func TestOptionsType(t *testing.T) {
+	app := newTestServer(t).app()
+	for _, options := range []string{`"foo"`, `[]`, `1`} {
+		resp := do(t, app, fiber.MethodPost, "/", `{"formula":"p","options":`+options+`,"timeout":5}`)
+		var res struct {
+			Error   string `json:"error"`
+			Details []struct {
+				Path string `json:"path"`
+			} `json:"details"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != fiber.StatusBadRequest || len(res.Details) == 0 || res.Details[0].Path != "/options" {
+			t.Errorf("options %s: status = %d, body = %+v", options, resp.StatusCode, res)
+		}
+	}
+	// form bodies bypass the schema
+	resp := do(t, app, fiber.MethodPost, "/", "formula=p&timeout=5", fiber.HeaderContentType, fiber.MIMEApplicationForm)
+	var res testResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusBadRequest || res.Error != "options must be a JSON object" {
+		t.Errorf("form: status = %d, error = %q", resp.StatusCode, res.Error)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	_, res := prove(t, newTestServer(t, "INCLUDE_SUMMARY", "true").app(), `{"formula":"p","options":{},"timeout":5}`)
+	if !regexp.MustCompile(`^outcome=done result=provable steps=3 prover=prover dur=\d+ms$`).MatchString(res.Summary) {
+		t.Errorf("summary = %q", res.Summary)
+	}
+	if got := summaryValue("a b"); got != `"a b"` {
+		t.Errorf("summaryValue = %s, want quoted", got)
+	}
+}
+
+func TestResultKeyPolicy(t *testing.T) {
+	app := newTestServer(t, "RESULT_KEY_POLICY", "strict", "RESULT_KEYS", "result").app()
+	_, res := prove(t, app, `{"formula":"p","options":{},"timeout":5}`)
+	if _, ok := res.Result["steps"]; ok || res.Result["result"] != "provable" {
+		t.Errorf("strict result = %v, want steps dropped", res.Result)
+	}
+	_, res = prove(t, newTestServer(t, "RESULT_KEY_POLICY", "", "RESULT_KEYS", "").app(), `{"formula":"p","options":{},"timeout":5}`)
+	if res.Result["steps"] != float64(3) {
+		t.Errorf("passthrough result = %v, want steps", res.Result)
+	}
+
+	t.Setenv("RESULT_KEY_POLICY", "strict")
+	if _, err := loadConfig(); err == nil {
+		t.Error("want error for strict without RESULT_KEYS")
+	}
+}
+
+func TestEncodeFile(t *testing.T) {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	name := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(name, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	want := base64.StdEncoding.EncodeToString(data)
+	got, err := encodeFile(name, len(want))
+	if err != nil || got != want {
+		t.Errorf("encodeFile = %q, %v, want standard encoding", got, err)
+	}
+	if _, err := encodeFile(name, len(want)-1); !errors.Is(err, errTooLarge) {
+		t.Errorf("err = %v, want errTooLarge", err)
+	}
+}
+
+func TestCORSExposeHeaders(t *testing.T) {
+	app := newTestServer(t, "CORS_ORIGINS", "https://example.com").app()
+	resp := do(t, app, fiber.MethodGet, "/livez", "", fiber.HeaderOrigin, "https://example.com")
+	got := strings.Split(resp.Header.Get(fiber.HeaderAccessControlExposeHeaders), ",")
+	for _, header := range exposedHeaders {
+		if !slices.Contains(got, header) {
+			t.Errorf("%s not exposed in %v", header, got)
+		}
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	logs := captureLogs(t)
+	s := newTestServer(t, "PROVERS", "prover")
+	s.ready.Store(false)
+	app := s.app()
+	if resp := do(t, app, fiber.MethodGet, "/readyz", ""); resp.StatusCode != fiber.StatusServiceUnavailable {
+		t.Errorf("readyz before warm-up = %d, want 503", resp.StatusCode)
+	}
+	if resp, res := prove(t, app, `{"formula":"p","options":{},"timeout":5}`); resp.StatusCode != fiber.StatusServiceUnavailable || res.Error != "warming up" {
+		t.Errorf("status = %d, error = %q, want 503 warming up", resp.StatusCode, res.Error)
+	}
+
+	// canceled on shutdown
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	s.warmUp(ctx)
+	if s.ready.Load() {
+		t.Error("ready after canceled warm-up")
+	}
+
+	s.warmUp(t.Context())
+	if resp := do(t, app, fiber.MethodGet, "/readyz", ""); resp.StatusCode != fiber.StatusOK {
+		t.Errorf("readyz after warm-up = %d, want 200", resp.StatusCode)
+	}
+	if !regexp.MustCompile(`"msg":"Ready".*"version":"stub 1.0"`).MatchString(logs.String()) {
+		t.Errorf("versions not logged when ready: %s", logs)
+	}
+}
+
+func TestExplanationLanguage(t *testing.T) {
+	app := newTestServer(t,
+		"EXPLANATION_TEMPLATE", "The formula is {{.result}}.",
+		"EXPLANATION_TEMPLATES", `{"de":"Die Formel ist {{.result}}."}`,
+	).app()
+	for _, tt := range []struct {
+		acceptLanguage, want string
+	}{
+		{"", "The formula is provable."},
+		{"de", "Die Formel ist provable."},
+		{"en-US,de;q=0.5", "The formula is provable."},
+		{"*", "The formula is provable."},
+		{"fr", "The formula is provable."},
+	} {
+		_, res := prove(t, app, `{"formula":"p","options":{},"timeout":5}`, fiber.HeaderAcceptLanguage, tt.acceptLanguage)
+		if res.Result["explanation"] != tt.want {
+			t.Errorf("Accept-Language %q: explanation = %v, want %s", tt.acceptLanguage, res.Result["explanation"], tt.want)
+		}
+	}
+}
+
+func TestDraining(t *testing.T) {
+	s := newTestServer(t)
+	app := s.app()
+	s.draining.Store(true)
+	resp, res := prove(t, app, `{"formula":"p","options":{},"timeout":5}`)
+	if resp.StatusCode != fiber.StatusServiceUnavailable || res.Error != "shutting down" || !resp.Close {
+		t.Errorf("status = %d, error = %q, close = %t", resp.StatusCode, res.Error, resp.Close)
+	}
+	if resp := do(t, app, fiber.MethodGet, "/readyz", ""); resp.StatusCode != fiber.StatusServiceUnavailable {
+		t.Errorf("readyz while draining = %d, want 503", resp.StatusCode)
+	}
+}
+
+func TestCheckFields(t *testing.T) {
+	for _, tt := range []struct {
+		req  Request
+		want string
+	}{
+		{Request{Timeout: 5}, ""},
+		{Request{Timeout: 5, TimeoutMs: 100}, "fields are mutually exclusive: timeout, timeout_ms"},
+		{Request{Timeout: 5, Verify: true, Derivation: "d"}, ""},
+		{Request{Timeout: 5, Verify: true}, "fields are required together: verify, derivation; missing: derivation"},
+	} {
+		got := ""
+		if err := checkFields(&tt.req); err != nil {
+			got = err.Error()
+		}
+		if got != tt.want {
+			t.Errorf("%+v: err = %q, want %q", tt.req, got, tt.want)
+		}
+	}
+
+	// rejected by the schema first
+	app := newTestServer(t).app()
+	for _, body := range []string{
+		`{"formula":"p","options":{},"timeout":5,"timeout_ms":100}`,
+		`{"formula":"p","options":{},"timeout":5,"derivation":"d"}`,
+	} {
+		resp, res := prove(t, app, body)
+		if resp.StatusCode != fiber.StatusBadRequest || res.Error != "schema violation" {
+			t.Errorf("%s: status = %d, error = %q", body, resp.StatusCode, res.Error)
+		}
+	}
+}
+
+func TestVerifyMode(t *testing.T) {
+	body := `{"formula":"p","options":{},"timeout":5,"verify":true,"derivation":"p ⊢ p"}`
+	resp, res := prove(t, newTestServer(t).app(), body)
+	if resp.StatusCode != fiber.StatusBadRequest || res.Error != "verify mode is disabled" {
+		t.Errorf("status = %d, error = %q, want 400 if disabled", resp.StatusCode, res.Error)
+	}
+
+	app := newTestServer(t, "VERIFY_ARGS", `["--verify","{derivation}"]`).app()
+	resp, res = prove(t, app, body)
+	if got := res.Files["txt"]["verified"]; got != "p ⊢ p" {
+		t.Errorf("verified = %q, want supplied derivation", got)
+	}
+	if !strings.Contains(resp.Header.Get(headerCapabilities), "verify") {
+		t.Errorf("%s = %q, want verify", headerCapabilities, resp.Header.Get(headerCapabilities))
+	}
+}
+
+func TestMaxComplexity(t *testing.T) {
+	app := newTestServer(t, "MAX_COMPLEXITY", "2", "STUB_LOG", filepath.Join(t.TempDir(), "log")).app()
+	resp, res := prove(t, app, `{"formula":"p∧q∧r∨s","options":{},"timeout":5}`)
+	if resp.StatusCode != fiber.StatusBadRequest || res.Error != "formula too complex: 3 connectives and quantifiers, max 2" {
+		t.Errorf("status = %d, error = %q", resp.StatusCode, res.Error)
+	}
+	if _, err := os.Stat(os.Getenv("STUB_LOG")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("prover ran: %v", err)
+	}
+	if resp, _ := prove(t, app, `{"formula":"p∧q","options":{},"timeout":5}`); resp.StatusCode != fiber.StatusOK {
+		t.Errorf("status = %d, want 200 within limit", resp.StatusCode)
+	}
+}
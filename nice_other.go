@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// setNice does nothing on platforms without nice values, such as Windows.
+func setNice(_, _ int) error {
+	return nil
+}
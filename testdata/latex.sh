@@ -0,0 +1,17 @@
+#!/bin/sh
+# Stub LaTeX command for tests, writing a fake PDF of the last argument.
+
+# record invocations and environment if requested
+if [ -n "$STUB_LOG" ]; then
+	echo "$(basename "$0") $*" >>"$STUB_LOG"
+	env >>"$STUB_LOG"
+fi
+
+for arg; do
+	case "$arg" in
+	-output-directory=*) dir=${arg#-output-directory=} ;;
+	esac
+	tex=$arg
+done
+name=$(basename "$tex" .tex)
+echo "%PDF-stub" >"$dir/$name.pdf"
@@ -0,0 +1,164 @@
+#!/bin/sh
+# Stub prover for tests, behaving by the formula in the output directory.
+
+# record invocations if requested
+if [ -n "$STUB_LOG" ]; then
+	echo "$(basename "$0") $*" >>"$STUB_LOG"
+fi
+
+# print version on probe
+if [ "$1" = --version ]; then
+	echo "stub 1.0"
+	exit 0
+fi
+
+# parse arguments
+args="$*"
+out=""
+emit=""
+derivation=""
+while [ $# -gt 0 ]; do
+	case "$1" in
+	--out) out=$2 && shift ;;
+	--emit=*) emit="$emit ${1#--emit=}" ;;
+	--verify) derivation=$2 && shift ;;
+	esac
+	shift
+done
+if [ -z "$out" ]; then
+	echo "missing --out"
+	exit 2
+fi
+cd "$out" || exit 2
+
+# write requested output formats and verified derivation
+for ext in $emit; do
+	echo "proof" >"proof.$ext"
+done
+if [ -n "$derivation" ]; then
+	cp "$derivation" verified.txt
+fi
+
+case "$(cat formula.txt)" in
+args)
+	echo "$args"
+	;;
+options)
+	cat options.json
+	;;
+env)
+	env
+	;;
+nice)
+	# wait for the server to apply the limit after start
+	sleep 0.5
+	cut -d ' ' -f 19 /proc/$$/stat
+	;;
+files)
+	sleep 0.5
+	ulimit -n
+	;;
+nested)
+	mkdir -p a/b/c/d/e
+	echo "shallow" >a/shallow.txt
+	echo "deep" >a/b/c/d/e/deep.txt
+	;;
+symlink)
+	echo "ok" >ok.txt
+	ln -s /etc/passwd leak.txt
+	;;
+empty)
+	: >result.yaml
+	exit 0
+	;;
+alias)
+	printf 'a: &a [x, x]\nb: *a\n' >result.yaml
+	exit 0
+	;;
+deep)
+	{
+		printf 'a: '
+		head -c 100000 /dev/zero | tr '\0' '['
+		head -c 100000 /dev/zero | tr '\0' ']'
+		echo
+	} >result.yaml
+	exit 0
+	;;
+bom)
+	printf '\357\273\277result: provable\n' >result.yaml
+	exit 0
+	;;
+badutf)
+	printf 'result: "a\377b"\n' >result.yaml
+	exit 0
+	;;
+warnings)
+	printf 'result: provable\nwarnings: [w1, w2]\ntimings: {parse: 1, search: 2.5}\n' >result.yaml
+	exit 0
+	;;
+unprovable)
+	echo "result: unprovable" >result.yaml
+	exit 0
+	;;
+lines)
+	seq 10
+	;;
+flood)
+	# stop at the output budget before writing result.yaml
+	head -c 100000 /dev/zero | tr '\0' x
+	exec sleep 5
+	;;
+bigfile)
+	head -c 100000 /dev/zero >big.txt
+	exec sleep 5
+	;;
+sleep)
+	exec sleep 5
+	;;
+slowresult)
+	echo "result: partial" >result.yaml
+	exec sleep 5
+	;;
+failresult)
+	echo "result: partial" >result.yaml
+	exit 1
+	;;
+fail)
+	echo "failed"
+	exit 1
+	;;
+kill)
+	echo "killed"
+	kill -9 $$
+	;;
+vanish)
+	rm -rf "$out"
+	exit 0
+	;;
+tracefail)
+	if [ "$(basename "$0")" = prover-trace ]; then
+		echo "trace failed"
+		exit 1
+	fi
+	;;
+traceoptions)
+	if [ "$(basename "$0")" = prover-trace ]; then
+		exit 1
+	fi
+	cat options.json
+	;;
+json)
+	echo '{"a":1}' >proof.json
+	;;
+same)
+	echo "same" >a.txt
+	echo "same" >b.txt
+	;;
+tex)
+	echo '\documentclass{article}' >proof.tex
+	;;
+esac
+
+# write default result
+echo "proof" >proof.txt
+printf 'result: provable\nsteps: 3\n' >result.yaml
@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import "os"
+
+// maxRSS is not supported on this platform.
+func maxRSS(_ *os.ProcessState) (int64, bool) {
+	return 0, false
+}
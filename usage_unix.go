@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// maxRSS returns the peak resident set size of the exited process in bytes.
+func maxRSS(ps *os.ProcessState) (int64, bool) {
+	ru, ok := ps.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0, false
+	}
+	// darwin reports bytes, others kilobytes
+	if runtime.GOOS == "darwin" {
+		return int64(ru.Maxrss), true
+	}
+	return int64(ru.Maxrss) * 1024, true
+}